@@ -2,53 +2,136 @@ package aggregator
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
-	"log"
+	"time"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
 
 	"sync"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 var certUpdates = make(chan CertStoreChange, 10)
-var certUpdatesOutgoing []chan CertStoreChange
-var certUpdatesOutgoingLock sync.Mutex
+
+// Closed once the aggregator stopped, so importers don't wait on it forever.
+var aggregatorDone = make(chan struct{})
+
+var certManagers []*CertManager
+var certManagersLock sync.Mutex
 
 func StartAggregating(ctx context.Context) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		var cm CertStoreChange
+		var flushes []chan struct{}
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		// handle applies a change, returning the context and span handing it
+		// on to the exporters is traced in
+		handle := func(cm CertStoreChange) (context.Context, trace.Span) {
+			switch {
+			case cm.flushed != nil:
+				flushes = append(flushes, cm.flushed)
+			case cm.restored != nil:
+				restoreHeld(cm.restored)
+				markStateDirty()
+			case cm.senderRemoved:
+				removeSender(cm.Sender)
+				logging.Info("Dropped the certificates of a stopped importer", "sender", cm.Sender)
+			default:
+				changeCtx, span := cm.StartSpan(ctx, "aggregator.change")
+				recordChange(cm)
+				applyChange(cm)
+				logging.Info("Importer produced an update", "sender", cm.Sender, "added", len(cm.CertDiff.Added), "removed", len(cm.CertDiff.Removed))
+				return changeCtx, span
+			}
+			return ctx, nil
+		}
 
 	runLoop:
 		for {
+			changeCtx := ctx
+			var span trace.Span
 			select {
-			case cm = <-certUpdates:
-				certUpdatesOutgoingLock.Lock()
-				for _, channel := range certUpdatesOutgoing {
-					channel <- cm
-				}
-				certUpdatesOutgoingLock.Unlock()
-				log.Printf("\"%s\" has produced an update", cm.Sender)
+			case cm := <-certUpdates:
+				changeCtx, span = handle(cm)
+			case <-reconcileRequests:
+			case <-timer.C:
 			case <-ctx.Done():
 				break runLoop
 			}
+
+			next := reconcile(changeCtx)
+			saveState()
+			if span != nil {
+				span.End()
+			}
+			for _, flushed := range flushes {
+				close(flushed)
+			}
+			flushes = nil
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if !next.IsZero() {
+				timer.Reset(time.Until(next))
+			}
 		}
+
+		// Changes importers handed over before the stop are still passed on,
+		// so exporters don't miss them once their channels are closed. The
+		// exporters outlive the aggregator, but are only waited on for a while.
+		var spans []trace.Span
+		drained := false
+	drain:
+		for {
+			select {
+			case cm := <-certUpdates:
+				drained = true
+				if _, span := handle(cm); span != nil {
+					spans = append(spans, span)
+				}
+			default:
+				break drain
+			}
+		}
+		if drained {
+			drainCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			reconcile(drainCtx)
+			cancel()
+		}
+		for _, span := range spans {
+			span.End()
+		}
+		for _, flushed := range flushes {
+			close(flushed)
+		}
+
 		certUpdatesOutgoingLock.Lock()
 		defer certUpdatesOutgoingLock.Unlock()
-		log.Println("Cleaning up exporter channels")
-		for _, channel := range certUpdatesOutgoing {
-			close(channel)
+		logging.Debug("Cleaning up exporter channels")
+		for _, out := range certUpdatesOutgoing {
+			close(out.ch)
 		}
+		outputsClosed = true
+		close(aggregatorDone)
+		writeState()
 	}()
 	wg.Wait()
-	log.Println("Core Aggregator finished")
+	logging.Info("Core Aggregator finished")
 }
 
 type CertPackage struct {
 	Cert  *x509.Certificate
 	Chain []*x509.Certificate
-	Key   *rsa.PrivateKey
+	Key   crypto.Signer
 }
 
 type CertEntry struct {
@@ -57,11 +140,19 @@ type CertEntry struct {
 }
 
 type CertManager struct {
-	certs      map[string]CertEntry
-	lock       sync.Mutex
-	changeChan chan CertDiff
-	name       string
-	diff       CertDiff
+	certs  map[string]CertEntry
+	lock   sync.Mutex
+	name   string
+	diff   CertDiff
+	synced bool
+	// Span of the poll making the current round of changes
+	spanContext trace.SpanContext
+
+	// What the last completed round of changes left behind, readable while
+	// the next round is in progress.
+	published     []CertPackage
+	lastSync      time.Time
+	publishedLock sync.RWMutex
 }
 
 type CertDiff struct {
@@ -72,39 +163,74 @@ type CertDiff struct {
 type CertStoreChange struct {
 	CertDiff CertDiff
 	Sender   string
+
+	// Set on an importer's first change, which holds everything it has and
+	// replaces whatever was restored for it.
+	Resync bool
+
+	// Closed once everything queued before has been handed to the exporters.
+	flushed chan struct{}
+
+	// Set once the sender was stopped, everything held from it is dropped.
+	senderRemoved bool
+
+	// Saved certificates whose key could only be opened after startup.
+	restored []restoredCert
+
+	// Span the change was made in, so handling it continues the same trace.
+	spanContext trace.SpanContext
 }
 
-func NewOutputChan() chan CertStoreChange {
-	certUpdatesOutgoingLock.Lock()
-	defer certUpdatesOutgoingLock.Unlock()
-	c := make(chan CertStoreChange, 5)
-	certUpdatesOutgoing = append(certUpdatesOutgoing, c)
-	return c
+// LastSync returns when the importer with the given name last completed a poll.
+func LastSync(name string) time.Time {
+	certManagersLock.Lock()
+	defer certManagersLock.Unlock()
+	for _, cm := range certManagers {
+		if cm.name == name {
+			return cm.LastSync()
+		}
+	}
+	return time.Time{}
 }
 
+// ImportedCerts returns the certificates the importer with the given name
+// held after its last completed poll, before any filters are applied.
+func ImportedCerts(name string) []CertPackage {
+	certManagersLock.Lock()
+	defer certManagersLock.Unlock()
+	for _, cm := range certManagers {
+		if cm.name == name {
+			return cm.Certs()
+		}
+	}
+	return nil
+}
+
+// NewCertManager creates the manager of an importer. It replaces any earlier
+// one of the same name, as happens when an importer changes its type.
 func NewCertManager(name string) *CertManager {
-	cc := make(chan CertDiff)
 	c := CertManager{
-		changeChan: cc,
-		name:       name,
-		certs:      make(map[string]CertEntry),
+		name:  name,
+		certs: make(map[string]CertEntry),
 	}
 
-	go func() {
-		for certDiff := range cc {
-			csc := CertStoreChange{
-				Sender:   c.name,
-				CertDiff: certDiff,
-			}
-			certUpdates <- csc
+	certManagersLock.Lock()
+	defer certManagersLock.Unlock()
+	for i, cm := range certManagers {
+		if cm.name == name {
+			certManagers[i] = &c
+			return &c
 		}
-	}()
-
+	}
+	certManagers = append(certManagers, &c)
 	return &c
 }
 
-func (c *CertManager) BeginChanges() {
+// BeginChanges starts a round of changes. The span in ctx, if any, becomes
+// the parent of the aggregator's span handling them.
+func (c *CertManager) BeginChanges(ctx context.Context) {
 	c.lock.Lock()
+	c.spanContext = trace.SpanContextFromContext(ctx)
 	for key, val := range c.certs {
 		val.accessed = false
 		c.certs[key] = val
@@ -116,13 +242,63 @@ func (c *CertManager) BeginChanges() {
 }
 
 func (c *CertManager) EndChanges() {
-	if len(c.diff.Added) > 0 || len(c.diff.Removed) > 0 {
-		c.changeChan <- c.diff
+	metrics.DiffCerts.WithLabelValues(c.name, "added").Add(float64(len(c.diff.Added)))
+	metrics.DiffCerts.WithLabelValues(c.name, "removed").Add(float64(len(c.diff.Removed)))
+	if len(c.diff.Added) > 0 || len(c.diff.Removed) > 0 || !c.synced {
+		select {
+		case certUpdates <- CertStoreChange{Sender: c.name, CertDiff: c.diff, Resync: !c.synced, spanContext: c.spanContext}:
+		case <-aggregatorDone:
+		}
+		c.synced = true
+	}
+
+	published := make([]CertPackage, 0, len(c.certs))
+	for _, ce := range c.certs {
+		published = append(published, ce.certs)
 	}
+	c.publishedLock.Lock()
+	c.published = published
+	c.lastSync = time.Now()
+	c.publishedLock.Unlock()
 
 	c.lock.Unlock()
 }
 
+// AbortChanges ends a round of changes which could not be completed, keeping
+// the certificates held before it.
+func (c *CertManager) AbortChanges() {
+	for _, ce := range c.diff.Added {
+		delete(c.certs, (*ce.Cert.SerialNumber).String())
+	}
+	c.diff.Added = c.diff.Added[:0]
+	c.lock.Unlock()
+}
+
+func (c *CertManager) reset() {
+	c.lock.Lock()
+	c.certs = make(map[string]CertEntry)
+	c.synced = false
+	c.lock.Unlock()
+
+	c.publishedLock.Lock()
+	c.published = nil
+	c.lastSync = time.Time{}
+	c.publishedLock.Unlock()
+}
+
+// Certs returns the certificates held after the last completed round of changes.
+func (c *CertManager) Certs() []CertPackage {
+	c.publishedLock.RLock()
+	defer c.publishedLock.RUnlock()
+	return c.published
+}
+
+func (c *CertManager) LastSync() time.Time {
+	c.publishedLock.RLock()
+	defer c.publishedLock.RUnlock()
+	return c.lastSync
+}
+
 func (c *CertManager) GetDiff() CertDiff {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -139,7 +315,7 @@ func (c *CertManager) DeleteUntouchedCerts() {
 	}
 }
 
-func (c *CertManager) AddCert(cert *x509.Certificate, chain []*x509.Certificate, key *rsa.PrivateKey) bool {
+func (c *CertManager) AddCert(cert *x509.Certificate, chain []*x509.Certificate, key crypto.Signer) bool {
 	cip := c.IsCertInPool(cert)
 
 	if !cip {
@@ -0,0 +1,91 @@
+package aggregator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+func (c CertPackage) Domains() []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, d := range append([]string{c.Cert.Subject.CommonName}, c.Cert.DNSNames...) {
+		d = strings.ToLower(d)
+		if d == "" || seen[d] {
+			continue
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+func (c CertPackage) ChainPEM() []byte {
+	var out []byte
+	for _, cert := range c.Chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return out
+}
+
+// KeyPEM encodes the private key in the form usual for its type: PKCS #1
+// for RSA, SEC 1 for ECDSA and PKCS #8 for anything else.
+func (c CertPackage) KeyPEM() []byte {
+	switch k := c.Key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(c.Key)
+	if err != nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// hasKey reports whether the package holds a usable private key.
+func (c CertPackage) hasKey() bool {
+	switch k := c.Key.(type) {
+	case nil:
+		return false
+	case *rsa.PrivateKey:
+		return len(k.Primes) >= 2
+	}
+	return true
+}
+
+// ParsePrivateKey parses a DER encoded private key in PKCS #1, SEC 1 or
+// PKCS #8 form.
+func ParsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return key, nil
+}
+
+func (c CertPackage) Fingerprint() string {
+	sum := sha256.Sum256(c.Cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,61 @@
+package aggregator
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"traefik-cert-aggregator/filter"
+	"traefik-cert-aggregator/logging"
+)
+
+var importFilters = make(map[string]*filter.Rules)
+var exportFilters = make(map[string]*filter.Rules)
+var filtersLock sync.Mutex
+
+// Which clients kept a held certificate from being exported, keyed by sender and serial.
+var filtered = make(map[string][]string)
+
+// SetImportFilter limits the certificates of an importer which are taken into
+// account at all.
+func SetImportFilter(name string, rules *filter.Rules) {
+	filtersLock.Lock()
+	importFilters[name] = rules
+	filtersLock.Unlock()
+	requestReconcile()
+}
+
+// SetExportFilter limits the certificates handed to an exporter.
+func SetExportFilter(name string, rules *filter.Rules) {
+	filtersLock.Lock()
+	exportFilters[name] = rules
+	filtersLock.Unlock()
+	requestReconcile()
+}
+
+func importFilter(name string) *filter.Rules {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	return importFilters[name]
+}
+
+func exportFilter(name string) *filter.Rules {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	return exportFilters[name]
+}
+
+func updateFiltered(now map[string][]string) {
+	heldLock.Lock()
+	defer heldLock.Unlock()
+	for key, by := range now {
+		sort.Strings(by)
+		entry, ok := held[key]
+		if !ok {
+			continue
+		}
+		if strings.Join(by, ",") != strings.Join(filtered[key], ",") {
+			logging.Info("Certificate filtered", "sender", entry.sender, "domain", entry.cert.Cert.Subject.CommonName, "serial", entry.cert.Cert.SerialNumber.String(), "filteredBy", strings.Join(by, ","))
+		}
+	}
+	filtered = now
+}
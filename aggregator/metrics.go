@@ -0,0 +1,63 @@
+package aggregator
+
+import (
+	"traefik-cert-aggregator/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	certsHeldDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "importer_certs_held"),
+		"Number of certificates held by an importer.", []string{"client"}, nil)
+	lastSyncDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "importer_last_successful_poll_seconds"),
+		"Unix time of the last successful poll of an importer.", []string{"client"}, nil)
+	queueDepthDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "exporter_queue_depth"),
+		"Number of changes waiting to be picked up by an exporter.", []string{"client"}, nil)
+	// Named as alerting rules expect it, without the namespace
+	notAfterDesc = prometheus.NewDesc("cert_not_after_seconds",
+		"Unix time a certificate for a domain expires at.", []string{"domain", "sender"}, nil)
+)
+
+type collector struct{}
+
+func init() {
+	metrics.Registry.MustRegister(collector{})
+}
+
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certsHeldDesc
+	ch <- lastSyncDesc
+	ch <- queueDepthDesc
+	ch <- notAfterDesc
+}
+
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	certManagersLock.Lock()
+	managers := append([]*CertManager{}, certManagers...)
+	certManagersLock.Unlock()
+
+	for _, cm := range managers {
+		certs := cm.Certs()
+		ch <- prometheus.MustNewConstMetric(certsHeldDesc, prometheus.GaugeValue, float64(len(certs)), cm.name)
+		if lastSync := cm.LastSync(); !lastSync.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastSyncDesc, prometheus.GaugeValue, float64(lastSync.Unix()), cm.name)
+		}
+
+		// Several certs can cover a domain while one is being renewed, report the newest.
+		notAfter := make(map[string]int64)
+		for _, cp := range certs {
+			for _, domain := range cp.Domains() {
+				if t := cp.Cert.NotAfter.Unix(); t > notAfter[domain] {
+					notAfter[domain] = t
+				}
+			}
+		}
+		for domain, t := range notAfter {
+			ch <- prometheus.MustNewConstMetric(notAfterDesc, prometheus.GaugeValue, float64(t), domain, cm.name)
+		}
+	}
+
+	for _, out := range outputs() {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(len(out.ch)), out.name)
+	}
+}
@@ -0,0 +1,208 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type output struct {
+	name    string
+	ch      chan CertStoreChange
+	done    chan struct{}
+	sent    uint64
+	applied uint64
+
+	// Certificates handed to the exporter, keyed by sender and serial.
+	delivered     map[string]heldEntry
+	deliveredLock sync.Mutex
+}
+
+var certUpdatesOutgoing []*output
+var certUpdatesOutgoingLock sync.Mutex
+var outputsClosed bool
+var reconcileRequests = make(chan struct{}, 1)
+
+// NewOutputChan returns the channel an exporter receives changes on. A
+// restarted exporter replaces the channel it was given before, and is sent
+// the full state again.
+func NewOutputChan(name string) chan CertStoreChange {
+	certUpdatesOutgoingLock.Lock()
+	defer certUpdatesOutgoingLock.Unlock()
+	out := &output{
+		name:      name,
+		ch:        make(chan CertStoreChange, 5),
+		done:      make(chan struct{}),
+		delivered: make(map[string]heldEntry),
+	}
+	if outputsClosed {
+		// The aggregator is gone, nothing will be sent any more
+		close(out.ch)
+		return out.ch
+	}
+	defer requestReconcile()
+	for i, existing := range certUpdatesOutgoing {
+		if existing.name == name {
+			close(existing.done)
+			certUpdatesOutgoing[i] = out
+			return out.ch
+		}
+	}
+	certUpdatesOutgoing = append(certUpdatesOutgoing, out)
+	return out.ch
+}
+
+// RemoveOutput forgets an exporter which is no longer running.
+func RemoveOutput(name string) {
+	certUpdatesOutgoingLock.Lock()
+	defer certUpdatesOutgoingLock.Unlock()
+	for i, out := range certUpdatesOutgoing {
+		if out.name == name {
+			close(out.done)
+			certUpdatesOutgoing = append(certUpdatesOutgoing[:i], certUpdatesOutgoing[i+1:]...)
+			return
+		}
+	}
+}
+
+// requestReconcile makes the aggregator recompute what every exporter should hold.
+func requestReconcile() {
+	select {
+	case reconcileRequests <- struct{}{}:
+	default:
+	}
+}
+
+// MarkApplied is called by an exporter once it has finished applying a
+// change received from its output channel.
+func MarkApplied(name string) {
+	if out := findOutput(name); out != nil {
+		atomic.AddUint64(&out.applied, 1)
+	}
+}
+
+// OutputApplied reports whether an exporter has applied every change sent to it.
+func OutputApplied(name string) bool {
+	out := findOutput(name)
+	return out != nil && atomic.LoadUint64(&out.applied) >= atomic.LoadUint64(&out.sent)
+}
+
+func findOutput(name string) *output {
+	certUpdatesOutgoingLock.Lock()
+	defer certUpdatesOutgoingLock.Unlock()
+	for _, out := range certUpdatesOutgoing {
+		if out.name == name {
+			return out
+		}
+	}
+	return nil
+}
+
+func outputs() []*output {
+	certUpdatesOutgoingLock.Lock()
+	defer certUpdatesOutgoingLock.Unlock()
+	return append([]*output{}, certUpdatesOutgoing...)
+}
+
+// sync sends an exporter whatever it needs to end up with the desired
+// certificates, as one change per sender. The lock is not held while
+// sending, so exporters can be restarted while the aggregator waits on them.
+func (out *output) sync(ctx context.Context, desired map[string]heldEntry) {
+	out.deliveredLock.Lock()
+	diffs := make(map[string]*CertDiff)
+	diffFor := func(sender string) *CertDiff {
+		if _, ok := diffs[sender]; !ok {
+			diffs[sender] = &CertDiff{}
+		}
+		return diffs[sender]
+	}
+	for key, entry := range out.delivered {
+		if _, ok := desired[key]; !ok {
+			diff := diffFor(entry.sender)
+			diff.Removed = append(diff.Removed, entry.cert)
+		}
+	}
+	for key, entry := range desired {
+		if _, ok := out.delivered[key]; !ok {
+			diff := diffFor(entry.sender)
+			diff.Added = append(diff.Added, entry.cert)
+		}
+	}
+	out.deliveredLock.Unlock()
+
+	for sender, diff := range diffs {
+		select {
+		case out.ch <- CertStoreChange{Sender: sender, CertDiff: *diff, spanContext: trace.SpanContextFromContext(ctx)}:
+			atomic.AddUint64(&out.sent, 1)
+		case <-out.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		out.deliveredLock.Lock()
+		for _, cp := range diff.Removed {
+			delete(out.delivered, certKey(sender, cp))
+		}
+		for _, cp := range diff.Added {
+			out.delivered[certKey(sender, cp)] = heldEntry{sender: sender, cert: cp}
+		}
+		out.deliveredLock.Unlock()
+	}
+}
+
+// Flush waits until every change importers completed so far has been handed
+// to the exporters, and applied by them.
+func Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case certUpdates <- CertStoreChange{flushed: flushed}:
+	case <-aggregatorDone:
+		return errors.New("aggregator stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-aggregatorDone:
+		return errors.New("aggregator stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		applied := true
+		for _, out := range outputs() {
+			if atomic.LoadUint64(&out.applied) < atomic.LoadUint64(&out.sent) {
+				applied = false
+			}
+		}
+		if applied {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// receivedBy lists the exporters a certificate has been handed to.
+func receivedBy(key string) []string {
+	var names []string
+	for _, out := range outputs() {
+		out.deliveredLock.Lock()
+		if _, ok := out.delivered[key]; ok {
+			names = append(names, out.name)
+		}
+		out.deliveredLock.Unlock()
+	}
+	return names
+}
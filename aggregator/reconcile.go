@@ -0,0 +1,151 @@
+package aggregator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"traefik-cert-aggregator/logging"
+)
+
+// ExpiryPolicy decides when certificates stop being handed to exporters.
+// With Withhold set, a certificate is withheld Grace before its NotAfter.
+// KeepLast still exports the newest expired certificate for a domain no
+// valid certificate sent to the same exporter covers.
+type ExpiryPolicy struct {
+	Withhold bool
+	Grace    time.Duration
+	KeepLast bool
+}
+
+var expiryPolicy ExpiryPolicy
+var expiryPolicyLock sync.Mutex
+
+func SetExpiryPolicy(p ExpiryPolicy) {
+	expiryPolicyLock.Lock()
+	defer expiryPolicyLock.Unlock()
+	expiryPolicy = p
+}
+
+func getExpiryPolicy() ExpiryPolicy {
+	expiryPolicyLock.Lock()
+	defer expiryPolicyLock.Unlock()
+	return expiryPolicy
+}
+
+// exportable splits the held certificates into those which may be exported
+// at the given time and those which expired, and works out when that next
+// changes.
+func exportable(now time.Time, policy ExpiryPolicy, filteredBy map[string][]string) (map[string]heldEntry, map[string]heldEntry, time.Time) {
+	heldLock.Lock()
+	defer heldLock.Unlock()
+
+	valid := make(map[string]heldEntry)
+	expired := make(map[string]heldEntry)
+	var next time.Time
+	for key, entry := range held {
+		if !importFilter(entry.sender).Allows(entry.cert.Domains()) {
+			filteredBy[key] = append(filteredBy[key], "importer "+entry.sender)
+			continue
+		}
+		withholdAt := entry.cert.Cert.NotAfter.Add(-policy.Grace)
+		if !policy.Withhold || now.Before(withholdAt) {
+			valid[key] = entry
+			if policy.Withhold && (next.IsZero() || withholdAt.Before(next)) {
+				next = withholdAt
+			}
+			continue
+		}
+		expired[key] = entry
+	}
+	return valid, expired, next
+}
+
+// keepLast adds to the certificates of an exporter the newest expired one
+// for every domain none of them covers, and notes which it kept.
+func keepLast(allowed map[string]heldEntry, expired map[string]heldEntry, kept map[string]bool) {
+	covered := make(map[string]bool)
+	for _, entry := range allowed {
+		for _, domain := range entry.cert.Domains() {
+			covered[domain] = true
+		}
+	}
+	var keys []string
+	for key := range expired {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := expired[keys[i]].cert.Cert.NotAfter, expired[keys[j]].cert.Cert.NotAfter
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		keep := false
+		for _, domain := range expired[key].cert.Domains() {
+			if !covered[domain] {
+				covered[domain] = true
+				keep = true
+			}
+		}
+		if keep {
+			allowed[key] = expired[key]
+			kept[key] = true
+		}
+	}
+}
+
+// setWithheld records the expired certificates no exporter was sent.
+func setWithheld(expired map[string]heldEntry, kept map[string]bool) {
+	heldLock.Lock()
+	defer heldLock.Unlock()
+	nowWithheld := make(map[string]bool)
+	for key, entry := range expired {
+		if kept[key] {
+			continue
+		}
+		nowWithheld[key] = true
+		if !withheld[key] {
+			logging.Warn("Withholding expired certificate", "sender", entry.sender, "domain", entry.cert.Cert.Subject.CommonName, "serial", entry.cert.Cert.SerialNumber.String())
+		}
+	}
+	withheld = nowWithheld
+}
+
+// reconcile brings every exporter in line with the current state, and
+// returns when it has to run again for certificates to be withheld.
+func reconcile(ctx context.Context) time.Time {
+	policy := getExpiryPolicy()
+	filteredBy := make(map[string][]string)
+	valid, expired, next := exportable(time.Now(), policy, filteredBy)
+	kept := make(map[string]bool)
+	for _, out := range outputs() {
+		rules := exportFilter(out.name)
+		// pick narrows certificates down to those routed to the exporter
+		// and allowed by its filter
+		pick := func(from map[string]heldEntry) map[string]heldEntry {
+			ret := make(map[string]heldEntry)
+			for key, entry := range from {
+				if !routed(entry.sender, out.name) {
+					continue
+				}
+				if !rules.Allows(entry.cert.Domains()) {
+					filteredBy[key] = append(filteredBy[key], "exporter "+out.name)
+					continue
+				}
+				ret[key] = entry
+			}
+			return ret
+		}
+		allowed := pick(valid)
+		// Whether a domain is covered depends on what this exporter is sent
+		if policy.KeepLast {
+			keepLast(allowed, pick(expired), kept)
+		}
+		out.sync(ctx, allowed)
+	}
+	setWithheld(expired, kept)
+	updateFiltered(filteredBy)
+	return next
+}
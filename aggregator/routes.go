@@ -0,0 +1,39 @@
+package aggregator
+
+import "sync"
+
+// Which importers feed each exporter, keyed by exporter name. Without any
+// routes every importer feeds every exporter.
+var routes map[string]map[string]bool
+var routesLock sync.Mutex
+
+// SetRoutes takes a routing table mapping importer names to the exporters
+// they feed. Exporters no importer is routed to receive nothing.
+func SetRoutes(table map[string][]string) {
+	byExporter := make(map[string]map[string]bool)
+	for importer, exporters := range table {
+		for _, exporter := range exporters {
+			if byExporter[exporter] == nil {
+				byExporter[exporter] = make(map[string]bool)
+			}
+			byExporter[exporter][importer] = true
+		}
+	}
+	if len(table) == 0 {
+		byExporter = nil
+	}
+
+	routesLock.Lock()
+	routes = byExporter
+	routesLock.Unlock()
+	requestReconcile()
+}
+
+func routed(sender string, exporter string) bool {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+	if routes == nil {
+		return true
+	}
+	return routes[exporter][sender]
+}
@@ -0,0 +1,168 @@
+package aggregator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const recentChangesKept = 50
+
+type heldEntry struct {
+	sender string
+	cert   CertPackage
+
+	// Loaded from the state file and not yet confirmed by the importer.
+	restored bool
+}
+
+type HeldCert struct {
+	Sender     string
+	Cert       CertPackage
+	Exporters  []string
+	Withheld   bool
+	Restored   bool
+	FilteredBy []string
+}
+
+type CertSummary struct {
+	Domains     []string
+	Serial      string
+	Fingerprint string
+}
+
+type ChangeEvent struct {
+	Time    time.Time
+	Sender  string
+	Added   []CertSummary
+	Removed []CertSummary
+}
+
+// The merged state of every importer, keyed by sender and serial.
+var held = make(map[string]heldEntry)
+var withheld = make(map[string]bool)
+var heldLock sync.RWMutex
+
+var recentChanges []ChangeEvent
+var recentChangesLock sync.Mutex
+
+func certKey(sender string, cp CertPackage) string {
+	return sender + "/" + cp.Cert.SerialNumber.String()
+}
+
+func applyChange(cm CertStoreChange) {
+	markStateDirty()
+	if cm.Resync {
+		dropPending(cm.Sender)
+	}
+	heldLock.Lock()
+	defer heldLock.Unlock()
+	if cm.Resync {
+		for key, entry := range held {
+			if entry.sender == cm.Sender {
+				delete(held, key)
+			}
+		}
+	}
+	for _, cp := range cm.CertDiff.Removed {
+		delete(held, certKey(cm.Sender, cp))
+	}
+	for _, cp := range cm.CertDiff.Added {
+		held[certKey(cm.Sender, cp)] = heldEntry{sender: cm.Sender, cert: cp}
+	}
+}
+
+// RemoveSender drops everything held from an importer which is no longer
+// running. Should it be started again, it starts over with a full sync.
+// The removal is queued behind the changes the importer made before it
+// stopped, so none of them bring its certificates back.
+func RemoveSender(name string) {
+	certManagersLock.Lock()
+	for _, cm := range certManagers {
+		if cm.name == name {
+			cm.reset()
+		}
+	}
+	certManagersLock.Unlock()
+
+	select {
+	case certUpdates <- CertStoreChange{Sender: name, senderRemoved: true}:
+	case <-aggregatorDone:
+	}
+}
+
+func removeSender(name string) {
+	markStateDirty()
+	dropPending(name)
+	heldLock.Lock()
+	defer heldLock.Unlock()
+	for key, entry := range held {
+		if entry.sender == name {
+			delete(held, key)
+		}
+	}
+}
+
+func summarize(certs []CertPackage) []CertSummary {
+	summaries := make([]CertSummary, 0, len(certs))
+	for _, cp := range certs {
+		summaries = append(summaries, CertSummary{
+			Domains:     cp.Domains(),
+			Serial:      cp.Cert.SerialNumber.String(),
+			Fingerprint: cp.Fingerprint(),
+		})
+	}
+	return summaries
+}
+
+func recordChange(cm CertStoreChange) {
+	recentChangesLock.Lock()
+	defer recentChangesLock.Unlock()
+	recentChanges = append(recentChanges, ChangeEvent{
+		Time:    time.Now(),
+		Sender:  cm.Sender,
+		Added:   summarize(cm.CertDiff.Added),
+		Removed: summarize(cm.CertDiff.Removed),
+	})
+	if len(recentChanges) > recentChangesKept {
+		recentChanges = recentChanges[len(recentChanges)-recentChangesKept:]
+	}
+}
+
+// RecentChanges returns the last changes produced by importers, newest first.
+func RecentChanges() []ChangeEvent {
+	recentChangesLock.Lock()
+	defer recentChangesLock.Unlock()
+	events := make([]ChangeEvent, len(recentChanges))
+	for i, ev := range recentChanges {
+		events[len(recentChanges)-1-i] = ev
+	}
+	return events
+}
+
+// HeldCerts returns every certificate currently held by the aggregator.
+func HeldCerts() []HeldCert {
+	heldLock.RLock()
+	var ret []HeldCert
+	for key, entry := range held {
+		ret = append(ret, HeldCert{
+			Sender:     entry.sender,
+			Cert:       entry.cert,
+			Withheld:   withheld[key],
+			Restored:   entry.restored,
+			FilteredBy: filtered[key],
+		})
+	}
+	heldLock.RUnlock()
+
+	for i := range ret {
+		ret[i].Exporters = receivedBy(certKey(ret[i].Sender, ret[i].Cert))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Sender != ret[j].Sender {
+			return ret[i].Sender < ret[j].Sender
+		}
+		return ret[i].Cert.Cert.Subject.CommonName < ret[j].Cert.Cert.Subject.CommonName
+	})
+	return ret
+}
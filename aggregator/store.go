@@ -0,0 +1,418 @@
+package aggregator
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"traefik-cert-aggregator/encryption"
+	"traefik-cert-aggregator/logging"
+)
+
+const stateVersion = 1
+
+type storedState struct {
+	Version int          `json:"version"`
+	SavedAt time.Time    `json:"savedAt"`
+	Certs   []storedCert `json:"certs"`
+}
+
+type storedCert struct {
+	Sender string `json:"sender"`
+	Chain  string `json:"chain"`
+	Key    string `json:"key"`
+}
+
+var stateFile string
+var stateDirty bool
+var stateLock sync.Mutex
+
+// Saved certificates whose key could not be opened yet. They are kept in the
+// file as they are, until they are restored or their importer replaces them.
+var pendingCerts []storedCert
+
+// Keys sealed so far by certificate, so only new keys go to the key source.
+var sealedKeys = make(map[string]string)
+
+// Set when the state file is only read, as for a dry run.
+var stateReadOnly bool
+
+var saveRequests = make(chan struct{}, 1)
+var saverOnce sync.Once
+var saveLock sync.Mutex
+
+// A key which could not be opened yet, because the key source did not answer.
+var errKeyUnavailable = errors.New("could not open key")
+
+// restoredCert is a pending certificate whose key could be opened later on.
+type restoredCert struct {
+	stored storedCert
+	cert   CertPackage
+}
+
+// LoadState restores the merged state saved in the given file, so exporters
+// are seeded before any importer has answered. Restored certificates of an
+// importer are replaced once it completes its first poll. Later changes are
+// saved to the same file. Keys the key source can't open right now, as
+// with Vault transit while Vault is down, are retried in the background.
+func LoadState(name string) error {
+	stateLock.Lock()
+	stateFile = name
+	stateLock.Unlock()
+	saverOnce.Do(func() { go runSaver() })
+
+	raw, err := ioutil.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Info("No saved state, starting empty", "file", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state, err := parseState(raw)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var pending []storedCert
+	heldLock.Lock()
+	stateLock.Lock()
+	for _, sc := range state.Certs {
+		cp, err := sc.decode(ctx)
+		if errors.Is(err, errKeyUnavailable) {
+			pending = append(pending, sc)
+			continue
+		}
+		if err != nil {
+			logging.Warn("Skipping saved certificate", "sender", sc.Sender, "error", err)
+			continue
+		}
+		held[certKey(sc.Sender, cp)] = heldEntry{sender: sc.Sender, cert: cp, restored: true}
+		if encryption.IsSealed([]byte(sc.Key)) {
+			sealedKeys[certKey(sc.Sender, cp)] = sc.Key
+		}
+	}
+	pendingCerts = pending
+	stateLock.Unlock()
+	logging.Info("Restored saved certificates", "count", len(held), "savedAt", state.SavedAt.Format(time.RFC3339))
+	heldLock.Unlock()
+
+	if len(pending) > 0 {
+		logging.Warn("Could not open saved keys, retrying in the background", "count", len(pending))
+		go restorePending()
+	}
+	return nil
+}
+
+// restorePending keeps trying to open the keys which could not be opened on
+// startup, until they are or their importers have replaced them.
+func restorePending() {
+	wait := 10 * time.Second
+	for {
+		select {
+		case <-time.After(wait):
+		case <-aggregatorDone:
+			return
+		}
+		stateLock.Lock()
+		pending := append([]storedCert{}, pendingCerts...)
+		stateLock.Unlock()
+		if len(pending) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		var restored []restoredCert
+		skipped := make(map[storedCert]bool)
+		for _, sc := range pending {
+			cp, err := sc.decode(ctx)
+			switch {
+			case err == nil:
+				restored = append(restored, restoredCert{stored: sc, cert: cp})
+			case !errors.Is(err, errKeyUnavailable):
+				logging.Warn("Skipping saved certificate", "sender", sc.Sender, "error", err)
+				skipped[sc] = true
+			}
+		}
+		cancel()
+		if len(skipped) > 0 {
+			stateLock.Lock()
+			kept := pendingCerts[:0]
+			for _, sc := range pendingCerts {
+				if !skipped[sc] {
+					kept = append(kept, sc)
+				}
+			}
+			pendingCerts = kept
+			stateLock.Unlock()
+		}
+		if len(restored) > 0 {
+			select {
+			case certUpdates <- CertStoreChange{restored: restored}:
+			case <-aggregatorDone:
+				return
+			}
+		}
+		if wait < 5*time.Minute {
+			wait *= 2
+		}
+	}
+}
+
+// restoreHeld adds certificates whose saved key could be opened late, unless
+// their importer has replaced them in the meantime.
+func restoreHeld(restored []restoredCert) {
+	heldLock.Lock()
+	defer heldLock.Unlock()
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	count := 0
+	for _, rc := range restored {
+		for i, sc := range pendingCerts {
+			if sc != rc.stored {
+				continue
+			}
+			pendingCerts = append(pendingCerts[:i], pendingCerts[i+1:]...)
+			key := certKey(sc.Sender, rc.cert)
+			held[key] = heldEntry{sender: sc.Sender, cert: rc.cert, restored: true}
+			sealedKeys[key] = sc.Key
+			count++
+			break
+		}
+	}
+	if count > 0 {
+		logging.Info("Restored saved certificates", "count", count)
+	}
+}
+
+// dropPending forgets the saved certificates of a sender which are still
+// waiting for their key, once the sender itself has replaced them.
+func dropPending(sender string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	kept := pendingCerts[:0]
+	for _, sc := range pendingCerts {
+		if sc.Sender != sender {
+			kept = append(kept, sc)
+		}
+	}
+	pendingCerts = kept
+}
+
+func parseState(raw []byte) (storedState, error) {
+	var state storedState
+	err := json.Unmarshal(raw, &state)
+	if err != nil {
+		return state, err
+	}
+	if state.Version != stateVersion {
+		return state, errors.New("unsupported state version")
+	}
+	return state, nil
+}
+
+// OpenState returns a saved state with every private key decrypted.
+func OpenState(ctx context.Context, raw []byte, ks encryption.KeySource) ([]byte, error) {
+	state, err := parseState(raw)
+	if err != nil {
+		return nil, err
+	}
+	for i, sc := range state.Certs {
+		if !encryption.IsSealed([]byte(sc.Key)) {
+			continue
+		}
+		key, err := encryption.Open(ctx, ks, []byte(sc.Key))
+		if err != nil {
+			return nil, err
+		}
+		state.Certs[i].Key = string(key)
+	}
+	return json.MarshalIndent(state, "", "  ")
+}
+
+func markStateDirty() {
+	stateLock.Lock()
+	stateDirty = true
+	stateLock.Unlock()
+}
+
+// SetStateReadOnly keeps the state file loaded by LoadState from being
+// written, so a dry run plans against it without changing it.
+func SetStateReadOnly() {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateReadOnly = true
+}
+
+// saveState has the merged state written if it changed since it was last
+// written. Keys are sealed by the saver, so a slow key source doesn't hold
+// up the aggregator.
+func saveState() {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if stateFile == "" || stateReadOnly || !stateDirty {
+		return
+	}
+	requestSave()
+}
+
+func requestSave() {
+	select {
+	case saveRequests <- struct{}{}:
+	default:
+	}
+}
+
+func runSaver() {
+	for range saveRequests {
+		if !writeState() {
+			time.AfterFunc(30*time.Second, requestSave)
+		}
+	}
+}
+
+// writeState seals and writes the merged state. Should a key not be sealed,
+// the last good file is left in place and the state stays dirty.
+func writeState() bool {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	stateLock.Lock()
+	if stateFile == "" || stateReadOnly || !stateDirty {
+		stateLock.Unlock()
+		return true
+	}
+	stateDirty = false
+	name := stateFile
+	state := storedState{Version: stateVersion, SavedAt: time.Now()}
+	state.Certs = append(state.Certs, pendingCerts...)
+	stateLock.Unlock()
+
+	heldLock.RLock()
+	entries := make(map[string]heldEntry, len(held))
+	for key, entry := range held {
+		entries[key] = entry
+	}
+	heldLock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ks := encryption.Default()
+	sealed := make(map[string]string)
+	for key, entry := range entries {
+		if len(entry.cert.Cert.Raw) == 0 || !entry.cert.hasKey() {
+			logging.Warn("Not saving incomplete certificate", "sender", entry.sender)
+			continue
+		}
+		keyPEM := entry.cert.KeyPEM()
+		if ks != nil {
+			stateLock.Lock()
+			cached, ok := sealedKeys[key]
+			stateLock.Unlock()
+			if !ok {
+				s, err := encryption.Seal(ctx, ks, keyPEM)
+				if err != nil {
+					logging.Error("Could not encrypt key, keeping the last saved state", "sender", entry.sender, "domain", entry.cert.Cert.Subject.CommonName, "serial", entry.cert.Cert.SerialNumber.String(), "error", err)
+					markStateDirty()
+					return false
+				}
+				cached = string(s)
+			}
+			sealed[key] = cached
+			keyPEM = []byte(cached)
+		}
+		state.Certs = append(state.Certs, storedCert{
+			Sender: entry.sender,
+			Chain:  string(entry.cert.ChainPEM()),
+			Key:    string(keyPEM),
+		})
+	}
+	stateLock.Lock()
+	sealedKeys = sealed
+	stateLock.Unlock()
+
+	raw, err := json.Marshal(state)
+	if err != nil {
+		logging.Error("Could not encode state", "error", err)
+		markStateDirty()
+		return false
+	}
+	err = writeFileAtomic(name, raw)
+	if err != nil {
+		logging.Error("Could not save state", "file", name, "error", err)
+		markStateDirty()
+		return false
+	}
+	return true
+}
+
+// writeFileAtomic replaces a file without leaving a partial one behind.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (sc storedCert) decode(ctx context.Context) (CertPackage, error) {
+	var cp CertPackage
+	rest := []byte(sc.Chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return cp, err
+		}
+		cp.Chain = append(cp.Chain, cert)
+	}
+	if len(cp.Chain) == 0 {
+		return cp, errors.New("no certificate in chain")
+	}
+	cp.Cert = cp.Chain[0]
+
+	keyPEM := []byte(sc.Key)
+	if encryption.IsSealed(keyPEM) {
+		var err error
+		keyPEM, err = encryption.Open(ctx, encryption.Default(), keyPEM)
+		if errors.Is(err, encryption.ErrUnavailable) {
+			return cp, fmt.Errorf("%w: %s", errKeyUnavailable, err)
+		}
+		if err != nil {
+			return cp, err
+		}
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return cp, errors.New("no private key")
+	}
+	key, err := ParsePrivateKey(block.Bytes)
+	if err != nil {
+		return cp, err
+	}
+	cp.Key = key
+	return cp, nil
+}
@@ -0,0 +1,295 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"traefik-cert-aggregator/encryption"
+)
+
+// testKeySource seals keys by flipping their bits, and fails with err while
+// it is set.
+type testKeySource struct {
+	lock sync.Mutex
+	err  error
+}
+
+func (v *testKeySource) Name() string {
+	return "test"
+}
+
+func (v *testKeySource) fail(err error) {
+	v.lock.Lock()
+	v.err = err
+	v.lock.Unlock()
+}
+
+func (v *testKeySource) flip(data []byte) ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.err != nil {
+		return nil, v.err
+	}
+	ret := make([]byte, len(data))
+	for i, b := range data {
+		ret[i] = ^b
+	}
+	return ret, nil
+}
+
+func (v *testKeySource) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return v.flip(plaintext)
+}
+
+func (v *testKeySource) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return v.flip(ciphertext)
+}
+
+func testCert(t *testing.T, domain string) CertPackage {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CertPackage{Cert: cert, Chain: []*x509.Certificate{cert}, Key: key}
+}
+
+// resetStore empties the held and saved state, before and after a test, and
+// returns the name of a state file to use.
+func resetStore(t *testing.T) string {
+	reset := func() {
+		heldLock.Lock()
+		held = make(map[string]heldEntry)
+		withheld = make(map[string]bool)
+		heldLock.Unlock()
+		stateLock.Lock()
+		stateFile, stateDirty, stateReadOnly = "", false, false
+		pendingCerts = nil
+		sealedKeys = make(map[string]string)
+		stateLock.Unlock()
+		encryption.SetDefault(nil)
+	}
+	reset()
+	t.Cleanup(reset)
+	return filepath.Join(t.TempDir(), "state.json")
+}
+
+// hold adds certificates to the held state, as an importer would.
+func hold(sender string, cps ...CertPackage) {
+	applyChange(CertStoreChange{Sender: sender, CertDiff: CertDiff{Added: cps}})
+}
+
+// save writes the held state to a file right away.
+func save(name string) bool {
+	stateLock.Lock()
+	stateFile = name
+	stateLock.Unlock()
+	markStateDirty()
+	return writeState()
+}
+
+// reload forgets the held state and loads it from a file again.
+func reload(t *testing.T, name string) {
+	heldLock.Lock()
+	held = make(map[string]heldEntry)
+	heldLock.Unlock()
+	stateLock.Lock()
+	pendingCerts = nil
+	sealedKeys = make(map[string]string)
+	stateLock.Unlock()
+	if err := LoadState(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func heldEntryOf(sender string, cp CertPackage) (heldEntry, bool) {
+	heldLock.RLock()
+	defer heldLock.RUnlock()
+	entry, ok := held[certKey(sender, cp)]
+	return entry, ok
+}
+
+func checkRestored(t *testing.T, sender string, cp CertPackage) {
+	entry, ok := heldEntryOf(sender, cp)
+	if !ok {
+		t.Fatalf("%s of %s was not restored", cp.Cert.Subject.CommonName, sender)
+	}
+	if !entry.restored {
+		t.Errorf("%s of %s is not marked restored", cp.Cert.Subject.CommonName, sender)
+	}
+	if !entry.cert.Cert.Equal(cp.Cert) {
+		t.Errorf("restored certificate of %s differs", cp.Cert.Subject.CommonName)
+	}
+	pub, _ := cp.Key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if entry.cert.Key == nil || !pub.Equal(entry.cert.Key.Public()) {
+		t.Errorf("restored key of %s differs", cp.Cert.Subject.CommonName)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	name := resetStore(t)
+	encryption.SetDefault(&testKeySource{})
+	a, b := testCert(t, "a.example.com"), testCert(t, "b.example.com")
+	hold("vault", a)
+	hold("kubernetes", b)
+	if !save(name) {
+		t.Fatal("state was not saved")
+	}
+
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("PRIVATE KEY-----")) {
+		t.Error("state file holds a plain text key")
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the state file to have mode 0600, got %v (%v)", fi.Mode().Perm(), err)
+	}
+
+	reload(t, name)
+	checkRestored(t, "vault", a)
+	checkRestored(t, "kubernetes", b)
+}
+
+func TestRestoredReplacedByFirstPoll(t *testing.T) {
+	name := resetStore(t)
+	old, other := testCert(t, "a.example.com"), testCert(t, "b.example.com")
+	hold("vault", old)
+	hold("kubernetes", other)
+	if !save(name) {
+		t.Fatal("state was not saved")
+	}
+	reload(t, name)
+
+	renewed := testCert(t, "a.example.com")
+	cm := NewCertManager("vault")
+	cm.BeginChanges(context.Background())
+	cm.AddCert(renewed.Cert, renewed.Chain, renewed.Key)
+	cm.DeleteUntouchedCerts()
+	cm.EndChanges()
+	applyChange(<-certUpdates)
+
+	if _, ok := heldEntryOf("vault", old); ok {
+		t.Error("restored certificate was kept after the importer's first poll")
+	}
+	if entry, ok := heldEntryOf("vault", renewed); !ok || entry.restored {
+		t.Errorf("polled certificate is missing or marked restored: %v", ok)
+	}
+	checkRestored(t, "kubernetes", other)
+}
+
+func TestFailedSealKeepsLastFile(t *testing.T) {
+	name := resetStore(t)
+	ks := &testKeySource{}
+	encryption.SetDefault(ks)
+	a := testCert(t, "a.example.com")
+	hold("vault", a)
+	if !save(name) {
+		t.Fatal("state was not saved")
+	}
+	good, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := testCert(t, "b.example.com")
+	hold("vault", b)
+	ks.fail(fmt.Errorf("%w: transit is down", encryption.ErrUnavailable))
+	if save(name) {
+		t.Fatal("state was saved although a key could not be sealed")
+	}
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, good) {
+		t.Error("last good state file was replaced")
+	}
+	stateLock.Lock()
+	dirty := stateDirty
+	stateLock.Unlock()
+	if !dirty {
+		t.Error("state is not dirty after a failed save")
+	}
+
+	ks.fail(nil)
+	if !writeState() {
+		t.Fatal("state was not saved once the key source is back")
+	}
+	reload(t, name)
+	checkRestored(t, "vault", a)
+	checkRestored(t, "vault", b)
+}
+
+func TestUnopenedKeysArePendingOrSkipped(t *testing.T) {
+	name := resetStore(t)
+	ks := &testKeySource{}
+	encryption.SetDefault(ks)
+	a := testCert(t, "a.example.com")
+	hold("vault", a)
+	if !save(name) {
+		t.Fatal("state was not saved")
+	}
+
+	// Kept for later while the key source is down
+	ks.fail(fmt.Errorf("%w: transit is down", encryption.ErrUnavailable))
+	reload(t, name)
+	if _, ok := heldEntryOf("vault", a); ok {
+		t.Fatal("certificate restored without its key")
+	}
+	stateLock.Lock()
+	pending := len(pendingCerts)
+	stateLock.Unlock()
+	if pending != 1 {
+		t.Fatalf("expected 1 pending certificate, got %d", pending)
+	}
+	if !save(name) {
+		t.Fatal("state was not saved")
+	}
+	ks.fail(nil)
+	reload(t, name)
+	checkRestored(t, "vault", a)
+
+	// Dropped when the key can't be opened at all
+	ks.fail(errors.New("message authentication failed"))
+	reload(t, name)
+	stateLock.Lock()
+	pending = len(pendingCerts)
+	stateLock.Unlock()
+	if _, ok := heldEntryOf("vault", a); ok || pending != 0 {
+		t.Errorf("expected the certificate to be skipped, held %v, pending %d", ok, pending)
+	}
+}
@@ -0,0 +1,25 @@
+package aggregator
+
+import (
+	"context"
+	"traefik-cert-aggregator/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StartSpan starts a span for handling a change, as a child of the span the
+// change was made in. An importer's poll is followed by the aggregator
+// handling its change, which is followed by every exporter applying what the
+// aggregator sent it, so one renewal can be traced from start to end.
+func (cm CertStoreChange) StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if cm.spanContext.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, cm.spanContext)
+	}
+	attrs = append(attrs,
+		attribute.String("sender", cm.Sender),
+		attribute.Int("added", len(cm.CertDiff.Added)),
+		attribute.Int("removed", len(cm.CertDiff.Removed)),
+	)
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
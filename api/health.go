@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"traefik-cert-aggregator/clients"
+)
+
+type healthResponse struct {
+	Status  string                 `json:"status"`
+	Leader  *bool                  `json:"leader,omitempty"`
+	Clients []clients.ClientStatus `json:"clients"`
+}
+
+// leader is only reported with leader election enabled.
+func leader() *bool {
+	enabled, isLeader := clients.Leader()
+	if !enabled {
+		return nil
+	}
+	return &isLeader
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// statuses reports the clients. Their last errors may name hosts, paths or
+// secrets, so they are only included for requests carrying the admin token.
+func statuses(r *http.Request, adminToken string) []clients.ClientStatus {
+	statuses := clients.Statuses()
+	if !authorized(r, adminToken) {
+		for i := range statuses {
+			statuses[i].LastError = ""
+		}
+	}
+	return statuses
+}
+
+// HealthHandler answers as long as the process is alive.
+func HealthHandler(adminToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, healthResponse{
+			Status:  "ok",
+			Leader:  leader(),
+			Clients: statuses(r, adminToken),
+		})
+	})
+}
+
+// ReadyHandler answers with 503 until every importer has completed a poll
+// and every exporter has applied the changes sent to it.
+func ReadyHandler(adminToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statuses := statuses(r, adminToken)
+		resp := healthResponse{Status: "ready", Leader: leader(), Clients: statuses}
+		code := http.StatusOK
+		for _, status := range statuses {
+			if !status.Ready {
+				resp.Status = "not ready"
+				code = http.StatusServiceUnavailable
+				break
+			}
+		}
+		if len(statuses) == 0 {
+			resp.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, resp)
+	})
+}
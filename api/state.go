@@ -0,0 +1,193 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+)
+
+type certificateResponse struct {
+	Sender      string    `json:"sender"`
+	Domains     []string  `json:"domains"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Exporters   []string  `json:"exporters"`
+	Withheld    bool      `json:"withheld"`
+	Restored    bool      `json:"restored"`
+	FilteredBy  []string  `json:"filteredBy"`
+}
+
+type chainCertResponse struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	PEM         string    `json:"pem"`
+}
+
+type certificateDetailResponse struct {
+	certificateResponse
+	Chain []chainCertResponse `json:"chain"`
+}
+
+type certSummaryResponse struct {
+	Domains     []string `json:"domains"`
+	Serial      string   `json:"serial"`
+	Fingerprint string   `json:"fingerprint"`
+}
+
+type changeResponse struct {
+	Time    time.Time             `json:"time"`
+	Sender  string                `json:"sender"`
+	Added   []certSummaryResponse `json:"added"`
+	Removed []certSummaryResponse `json:"removed"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Authenticated only lets requests through which carry the token as a bearer token.
+func Authenticated(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether a request carries the admin token. Without a
+// token configured, nothing is authorized.
+func authorized(r *http.Request, token string) bool {
+	given, ok := bearerToken(r.Header.Get("Authorization"))
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// bearerToken takes the token from an Authorization header, which has to
+// use the Bearer scheme.
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+func describeCert(held aggregator.HeldCert) certificateResponse {
+	cert := held.Cert.Cert
+	exporters := held.Exporters
+	if exporters == nil {
+		exporters = []string{}
+	}
+	filteredBy := held.FilteredBy
+	if filteredBy == nil {
+		filteredBy = []string{}
+	}
+	return certificateResponse{
+		Sender:      held.Sender,
+		Domains:     held.Cert.Domains(),
+		Issuer:      cert.Issuer.String(),
+		Serial:      cert.SerialNumber.String(),
+		Fingerprint: held.Cert.Fingerprint(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Exporters:   exporters,
+		Withheld:    held.Withheld,
+		Restored:    held.Restored,
+		FilteredBy:  filteredBy,
+	}
+}
+
+func describeChainCert(cert *x509.Certificate) chainCertResponse {
+	sum := sha256.Sum256(cert.Raw)
+	return chainCertResponse{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Serial:      cert.SerialNumber.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		PEM:         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+}
+
+func summaries(certs []aggregator.CertSummary) []certSummaryResponse {
+	ret := make([]certSummaryResponse, 0, len(certs))
+	for _, c := range certs {
+		ret = append(ret, certSummaryResponse{
+			Domains:     c.Domains,
+			Serial:      c.Serial,
+			Fingerprint: c.Fingerprint,
+		})
+	}
+	return ret
+}
+
+// CertificatesHandler serves /api/certificates and /api/certificates/<fingerprint>.
+// Private keys are never part of a response.
+func CertificatesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+			return
+		}
+
+		fingerprint := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/certificates"), "/")
+		held := aggregator.HeldCerts()
+		if fingerprint == "" {
+			ret := make([]certificateResponse, 0, len(held))
+			for _, h := range held {
+				ret = append(ret, describeCert(h))
+			}
+			writeJSON(w, http.StatusOK, ret)
+			return
+		}
+
+		for _, h := range held {
+			if h.Cert.Fingerprint() != strings.ToLower(fingerprint) {
+				continue
+			}
+			detail := certificateDetailResponse{certificateResponse: describeCert(h)}
+			for _, cert := range h.Cert.Chain {
+				detail.Chain = append(detail.Chain, describeChainCert(cert))
+			}
+			writeJSON(w, http.StatusOK, detail)
+			return
+		}
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "certificate not found"})
+	})
+}
+
+// ChangesHandler serves the most recent changes produced by importers.
+func ChangesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+			return
+		}
+		events := aggregator.RecentChanges()
+		ret := make([]changeResponse, 0, len(events))
+		for _, ev := range events {
+			ret = append(ret, changeResponse{
+				Time:    ev.Time,
+				Sender:  ev.Sender,
+				Added:   summaries(ev.Added),
+				Removed: summaries(ev.Removed),
+			})
+		}
+		writeJSON(w, http.StatusOK, ret)
+	})
+}
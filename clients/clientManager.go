@@ -3,13 +3,16 @@ package clients
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
 	"strings"
 	"sync"
-	"time"
 	"traefik-cert-aggregator/aggregator"
 	clientConfig "traefik-cert-aggregator/clients/config"
 	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/filter"
+	"traefik-cert-aggregator/leader"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
 	"traefik-cert-aggregator/util"
 )
 
@@ -21,82 +24,243 @@ type Client interface {
 type ImportClient interface {
 	Client
 	Start(*context.Context) error
+	// Poll fetches the certificates once, for running without a daemon.
+	Poll(context.Context) error
 }
 
 type ExportClient interface {
 	Client
 	Start(*context.Context, chan aggregator.CertStoreChange) error
+	// Plan describes what Start would do with the given changes, without
+	// changing anything.
+	Plan(context.Context, []aggregator.CertStoreChange) ([]PlanStep, error)
 }
 
-var registeredImportClients []ImportClient
-var registeredExportClients []ExportClient
+// Rejected is a secret an importer found but could not use.
+type Rejected struct {
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
 
-func toClientSlice[T Client](slice []T) []Client {
-	var ret []Client
-	for _, v := range slice {
-		ret = append(ret, v)
-	}
-	return ret
+// RejectReporter is implemented by importers which can list the secrets
+// their last poll could not use.
+type RejectReporter interface {
+	Rejected() []Rejected
+}
+
+// A client type built into the binary. Every name a type is enabled under
+// gets an instance of its own.
+type clientType struct {
+	kind string
+	name string
+	new  func(name string) Client
 }
 
-func StartClients(ctx *context.Context, cfg *config.Config) error {
-	wg := sync.WaitGroup{}
+var clientTypes []clientType
 
-	ic := toClientSlice(registeredImportClients)
-	importers := configureClients[ImportClient](&cfg.ImporterConfig, cfg.EnabledImporters, &ic)
+// Instances created so far, keyed by kind and name. A reload replaces the
+// instance of a client whose settings changed.
+var instances = make(map[string]Client)
+var instancesLock sync.Mutex
 
-	ec := toClientSlice(registeredExportClients)
-	exporters := configureClients[ExportClient](&cfg.ExporterConfig, cfg.EnabledExporters, &ec)
+// StartClients runs the enabled clients until they are stopped. Exporters run
+// with their own context, so they can finish applying what the aggregator
+// sent them after the importers are stopped.
+func StartClients(ctx *context.Context, exportCtx *context.Context, cfg *config.Config) error {
+	importers := configureClients[ImportClient](KindImporter, &cfg.ImporterConfig, cfg.EnabledImporters, aggregator.SetImportFilter)
+	exporters := configureClients[ExportClient](KindExporter, &cfg.ExporterConfig, cfg.EnabledExporters, aggregator.SetExportFilter)
 	if len(exporters) == 0 || len(importers) == 0 {
-		log.Printf("%d importer clients, %d exporter clients configured", len(importers), len(exporters))
+		logging.Error("Not enough clients configured", "importers", len(importers), "exporters", len(exporters))
 		return errors.New("no client configured for running")
 	}
-	wg.Add(2)
+	checkRoutes(cfg.Routes, importers, exporters)
+	aggregator.SetRoutes(cfg.Routes)
 
-	go func() {
-		runExportClients(ctx, exporters)
-		wg.Done()
-	}()
+	elector, err := leader.FromConfig(cfg.LeaderElection)
+	if err != nil {
+		return err
+	}
+	// Leadership is kept until the exporters are done, so another instance
+	// doesn't take over while they drain.
+	electCtx, stopElection := context.WithCancel(context.Background())
+	electionDone := make(chan struct{})
+	if elector != nil {
+		lead.enable()
+		go func() {
+			defer close(electionDone)
+			leader.Run(electCtx, elector, cfg.LeaderElection.TTL, lead.set)
+		}()
+	} else {
+		close(electionDone)
+	}
 
-	go func() {
-		runImportClients(ctx, importers)
-		wg.Done()
-	}()
+	runningLock.Lock()
+	importCtx, clientExportCtx = *ctx, *exportCtx
+	sup = &supervisor{cfg: cfg.Supervisor, stopping: (*ctx).Done()}
+	for _, c := range exporters {
+		cc, _ := c.GetInfo().Prepare(cfg.ExporterConfig.Get(c.GetInfo().Name))
+		startClient(KindExporter, c, cc)
+	}
+	for _, c := range importers {
+		cc, _ := c.GetInfo().Prepare(cfg.ImporterConfig.Get(c.GetInfo().Name))
+		startClient(KindImporter, c, cc)
+	}
+	runningLock.Unlock()
 
-	wg.Wait()
-	log.Println("All Clients Finished")
-	return nil
+	<-(*ctx).Done()
+	runningLock.Lock()
+	shuttingDown = true
+	runningLock.Unlock()
+	clientsWg.Wait()
+	stopElection()
+	<-electionDone
+	logging.Info("All Clients Finished")
+	return sup.failure()
 }
 
-func AddImportClient(c ImportClient) {
-	registeredImportClients = append(registeredImportClients, c)
-	log.Printf("Discovered import client \"%s\"", c.GetInfo().Name)
+// checkRoutes warns about routes that can never carry any certificates.
+func checkRoutes(routes map[string][]string, importers []ImportClient, exporters []ExportClient) {
+	if len(routes) == 0 {
+		return
+	}
+	importerNames := util.NewSet[string]()
+	for _, c := range importers {
+		importerNames.Add(c.GetInfo().Name)
+	}
+	exporterNames := util.NewSet[string]()
+	for _, c := range exporters {
+		exporterNames.Add(c.GetInfo().Name)
+	}
+
+	fed := util.NewSet[string]()
+	for importer, targets := range routes {
+		if !importerNames.Contains(importer) {
+			logging.Warn("Route from unknown or disabled importer", "importer", importer)
+		}
+		for _, exporter := range targets {
+			if !exporterNames.Contains(exporter) {
+				logging.Warn("Route to unknown or disabled exporter", "importer", importer, "exporter", exporter)
+			}
+			fed.Add(exporter)
+		}
+	}
+	for _, c := range exporters {
+		if !fed.Contains(c.GetInfo().Name) {
+			logging.Warn("No importer is routed to exporter", "exporter", c.GetInfo().Name)
+		}
+	}
 }
 
-func AddExportClient(c ExportClient) {
-	registeredExportClients = append(registeredExportClients, c)
-	log.Printf("Discovered export client \"%s\"", c.GetInfo().Name)
+// AddImportClient registers an importer type with the constructor creating
+// an instance of it under a given name.
+func AddImportClient[T ImportClient](typ string, new func(name string) T) {
+	clientTypes = append(clientTypes, clientType{kind: KindImporter, name: typ, new: func(name string) Client { return new(name) }})
+	logging.Debug("Discovered client", "client", typ, "kind", KindImporter)
+}
 
+// AddExportClient registers an exporter type with the constructor creating
+// an instance of it under a given name.
+func AddExportClient[T ExportClient](typ string, new func(name string) T) {
+	clientTypes = append(clientTypes, clientType{kind: KindExporter, name: typ, new: func(name string) Client { return new(name) }})
+	logging.Debug("Discovered client", "client", typ, "kind", KindExporter)
 }
 
-func configureClients[T Client](cfg *config.KeyedKVMap, clientWhitelist []string, clientMap *[]Client) []T {
-	var configured []T
+// ImportClients returns an importer of every type, named like its type.
+func ImportClients() []ImportClient {
+	var ret []ImportClient
+	for _, t := range clientTypes {
+		if t.kind == KindImporter {
+			c, _ := instance(KindImporter, t.name, nil)
+			ret = append(ret, c.(ImportClient))
+		}
+	}
+	return ret
+}
 
-	allowed := util.NewSet[string]()
-	for _, itm := range clientWhitelist {
-		allowed.Add(strings.ToLower(itm))
+// ExportClients returns an exporter of every type, named like its type.
+func ExportClients() []ExportClient {
+	var ret []ExportClient
+	for _, t := range clientTypes {
+		if t.kind == KindExporter {
+			c, _ := instance(KindExporter, t.name, nil)
+			ret = append(ret, c.(ExportClient))
+		}
 	}
+	return ret
+}
 
-	for _, client := range *clientMap {
-		name := client.GetInfo().Name
-		if !allowed.Contains(strings.ToLower(client.GetInfo().Name)) {
-			log.Printf("Client \"%s\" not whitelisted", name)
-			continue
+// instance returns the client running under a name, creating it on first
+// use. Its type key picks the type, which defaults to the name itself.
+func instance(kind string, name string, cc clientConfig.ClientConfiguration) (Client, error) {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	if c, ok := instances[kind+"/"+name]; ok && c.GetInfo().Type == typeOf(name, cc) {
+		return c, nil
+	}
+	c, err := newInstance(kind, name, cc)
+	if err != nil {
+		return nil, err
+	}
+	instances[kind+"/"+name] = c
+	return c, nil
+}
+
+// newInstance creates a client without making it the one running under its
+// name, see setInstance.
+func newInstance(kind string, name string, cc clientConfig.ClientConfiguration) (Client, error) {
+	typ := typeOf(name, cc)
+	for _, t := range clientTypes {
+		if t.kind == kind && t.name == typ {
+			return t.new(name), nil
+		}
+	}
+	if typ == name {
+		return nil, fmt.Errorf("unknown %s \"%s\"", kind, name)
+	}
+	return nil, fmt.Errorf("%s \"%s\" has unknown type \"%s\"", kind, name, typ)
+}
+
+func setInstance(kind string, name string, c Client) {
+	instancesLock.Lock()
+	instances[kind+"/"+name] = c
+	instancesLock.Unlock()
+}
+
+func typeOf(name string, cc clientConfig.ClientConfiguration) string {
+	if typ := strings.ToLower(cc["type"]); typ != "" {
+		return typ
+	}
+	return name
+}
+
+// enabledNames returns the names clients are enabled under, each only once.
+func enabledNames(enabled []string) []string {
+	seen := util.NewSet[string]()
+	var names []string
+	for _, name := range enabled {
+		name = strings.ToLower(name)
+		if !seen.Contains(name) {
+			seen.Add(name)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func configureClients[T Client](kind string, cfg *config.KeyedKVMap, enabled []string, setFilter func(string, *filter.Rules)) []T {
+	var configured []T
+	for _, name := range enabledNames(enabled) {
+		logging.Info("Initializing client", "client", name, "kind", kind)
+		client, err := instance(kind, name, cfg.Get(name))
+		if err == nil {
+			var clientCfg clientConfig.ClientConfiguration
+			clientCfg, err = client.GetInfo().Prepare(cfg.Get(name))
+			if err == nil {
+				err = configureClient(kind, client, clientCfg, setFilter)
+			}
 		}
-		log.Printf("Initiallizing client \"%s\"", name)
-		err := client.Configure(cfg.Get(name))
 		if err != nil {
-			log.Fatalf("Error while configuring \"%s\": %s", name, err)
+			logging.Fatal("Error while configuring client", "client", name, "kind", kind, "error", err)
 			continue
 		}
 		configured = append(configured, client.(T))
@@ -104,47 +268,52 @@ func configureClients[T Client](cfg *config.KeyedKVMap, clientWhitelist []string
 	return configured
 }
 
-func runImportClients(ctx *context.Context, clientSet []ImportClient) {
-	wg := sync.WaitGroup{}
-	for _, client := range clientSet {
-		wg.Add(1)
-		go func(clnt ImportClient, ctx context.Context) {
-		runLoop:
-			for {
-				log.Printf("Import client \"%s\" started", clnt.GetInfo().Name)
-
-				err := clnt.Start(&ctx)
-				select {
-				case <-time.After(time.Second):
-					log.Printf("Import client \"%s\" terminated with the following error. Restarting. %s", clnt.GetInfo().Name, err)
-				case <-(ctx).Done():
-					break runLoop
-				}
-			}
-			wg.Done()
-		}(client, *ctx)
-	}
-	wg.Wait()
-}
-
-func runExportClients(ctx *context.Context, clientSet []ExportClient) {
-	wg := sync.WaitGroup{}
-	for _, client := range clientSet {
-		wg.Add(1)
-		go func(clnt ExportClient) {
-
-		runLoop:
-			for {
-				err := clnt.Start(ctx, aggregator.NewOutputChan())
-				select {
-				case <-time.After(time.Second):
-					log.Printf("Export client \"%s\" terminated with the following error. Restarting. %s", clnt.GetInfo().Name, err)
-				case <-(*ctx).Done():
-					break runLoop
-				}
-			}
-			wg.Done()
-		}(client)
+// configureClient configures a client with settings checked by Prepare.
+func configureClient(kind string, client Client, clientCfg clientConfig.ClientConfiguration, setFilter func(string, *filter.Rules)) error {
+	for _, key := range client.GetInfo().Keys() {
+		if key.Secret {
+			logging.AddSecret(clientCfg[key.Key])
+		}
+	}
+	err := client.Configure(clientCfg)
+	if err != nil {
+		return err
+	}
+	rules, err := filter.Parse(clientCfg.Get("includeDomains", ""), clientCfg.Get("excludeDomains", ""))
+	if err != nil {
+		return err
+	}
+	// Shared with a client still running under the name, so only set once
+	// the new settings are known to work
+	err = logging.SetClientLevel(kind, client.GetInfo().Name, clientCfg.Get("logLevel", ""))
+	if err != nil {
+		return err
+	}
+	setFilter(client.GetInfo().Name, rules)
+	return nil
+}
+
+func runImportClient(ctx *context.Context, clnt ImportClient, critical bool) {
+	name := clnt.GetInfo().Name
+	sup.run(*ctx, KindImporter, name, critical, func() error {
+		err := clnt.Start(ctx)
+		if (*ctx).Err() == nil {
+			metrics.PollErrors.WithLabelValues(name).Inc()
+		}
+		return err
+	})
+}
+
+func runExportClient(ctx *context.Context, clnt ExportClient, critical bool, leaderOnly bool) {
+	name := clnt.GetInfo().Name
+	start := func(ctx context.Context) {
+		sup.run(ctx, KindExporter, name, critical, func() error {
+			return clnt.Start(&ctx, aggregator.NewOutputChan(name))
+		})
+	}
+	if enabled, _, _ := lead.get(); !leaderOnly || !enabled {
+		start(*ctx)
+		return
 	}
-	wg.Wait()
+	runLeaderOnly(*ctx, name, start)
 }
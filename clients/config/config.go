@@ -2,13 +2,19 @@ package config
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ClientConfiguration map[string]string
 
+// ClientInfo describes a client. Name is what it was enabled as, and Type
+// the kind of client, which is also its name unless the type key is set.
 type ClientInfo struct {
-	Name       string
-	ConfigHelp map[string]string
+	Name   string
+	Type   string
+	Schema []ConfigKey
 }
 
 func (c *ClientConfiguration) Get(key string, def string) string {
@@ -26,3 +32,38 @@ func (c *ClientConfiguration) GetErr(key string) (string, error) {
 
 	return "", fmt.Errorf("cannot get key \"%s\"", key)
 }
+
+func (c *ClientConfiguration) GetBool(key string) (bool, error) {
+	val, err := strconv.ParseBool(c.Get(key, "false"))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return val, nil
+}
+
+func (c *ClientConfiguration) GetInt(key string) (int, error) {
+	val, err := strconv.Atoi(c.Get(key, "0"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return val, nil
+}
+
+func (c *ClientConfiguration) GetDuration(key string) (time.Duration, error) {
+	val, err := time.ParseDuration(c.Get(key, "0s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return val, nil
+}
+
+// GetList splits a comma separated value, dropping empty items.
+func (c *ClientConfiguration) GetList(key string) []string {
+	var ret []string
+	for _, item := range strings.Split(c.Get(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"traefik-cert-aggregator/logging"
+)
+
+const (
+	TypeString   = "string"
+	TypeBool     = "bool"
+	TypeInt      = "int"
+	TypeDuration = "duration"
+	TypeList     = "list"
+	TypeLevel    = "level"
+)
+
+// ConfigKey describes one setting a client understands.
+type ConfigKey struct {
+	Key         string
+	Type        string
+	Required    bool
+	Default     string
+	Secret      bool
+	Description string
+}
+
+// CommonKeys are understood by every client.
+var CommonKeys = []ConfigKey{
+	{Key: "type", Type: TypeString, Description: "type of client, for running several under different names; the name when empty"},
+	{Key: "includeDomains", Type: TypeList, Description: "domain globs or re: patterns every name of a certificate has to match"},
+	{Key: "excludeDomains", Type: TypeList, Description: "domain globs or re: patterns no name of a certificate may match"},
+	{Key: "critical", Type: TypeBool, Default: "false", Description: "stop the process when this client fails for good"},
+	{Key: "logLevel", Type: TypeLevel, Description: "debug, info, warn or error, the global log level when empty"},
+}
+
+// LeaderOnlyKey lets an exporter run only on the instance holding
+// leadership. Exporters writing to shared systems default to true.
+func LeaderOnlyKey(def bool) ConfigKey {
+	return ConfigKey{Key: "leaderOnly", Type: TypeBool, Default: strconv.FormatBool(def), Description: "only run on the leader when leader election is enabled"}
+}
+
+// Keys returns the client's own keys followed by the common ones.
+func (i ClientInfo) Keys() []ConfigKey {
+	return append(append([]ConfigKey{}, i.Schema...), CommonKeys...)
+}
+
+// Prepare checks a configuration against the schema and returns it with
+// defaults filled in. Empty values count as unset.
+func (i ClientInfo) Prepare(cc ClientConfiguration) (ClientConfiguration, error) {
+	keys := make(map[string]ConfigKey)
+	for _, key := range i.Keys() {
+		keys[key.Key] = key
+	}
+
+	var problems []string
+	ret := make(ClientConfiguration)
+	for key, val := range cc {
+		if _, ok := keys[key]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown key \"%s\"", key))
+			continue
+		}
+		if val != "" {
+			ret[key] = val
+		}
+	}
+	for _, key := range i.Keys() {
+		if _, ok := ret[key.Key]; !ok {
+			if key.Required {
+				problems = append(problems, fmt.Sprintf("missing required key \"%s\"", key.Key))
+				continue
+			}
+			if key.Default == "" {
+				continue
+			}
+			ret[key.Key] = key.Default
+		}
+		if err := key.check(ret[key.Key]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return ret, nil
+}
+
+func (k ConfigKey) check(val string) error {
+	var err error
+	switch k.Type {
+	case TypeBool:
+		_, err = strconv.ParseBool(val)
+	case TypeInt:
+		_, err = strconv.Atoi(val)
+	case TypeDuration:
+		_, err = time.ParseDuration(val)
+	case TypeLevel:
+		_, err = logging.ParseLevel(val)
+	}
+	if err != nil && val != "" {
+		return fmt.Errorf("invalid %s \"%s\": expected %s", k.Key, val, k.Type)
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secret values hidden.
+func (i ClientInfo) Redacted(cc ClientConfiguration) ClientConfiguration {
+	ret := make(ClientConfiguration)
+	for key, val := range cc {
+		ret[key] = val
+	}
+	for _, key := range i.Keys() {
+		if _, ok := ret[key.Key]; ok && key.Secret {
+			ret[key.Key] = "<redacted>"
+		}
+	}
+	return ret
+}
@@ -0,0 +1,72 @@
+package exporters
+
+import (
+	"path"
+	"sort"
+	"traefik-cert-aggregator/aggregator"
+)
+
+// certSet mirrors the certificates an exporter has been sent, for exporters
+// whose target does not keep enough state to be rebuilt from diffs alone.
+type certSet map[string]aggregator.CertPackage
+
+func (s certSet) apply(cd aggregator.CertStoreChange) {
+	for _, elem := range cd.CertDiff.Removed {
+		delete(s, path.Join(cd.Sender, elem.Cert.SerialNumber.String()))
+	}
+	for _, elem := range cd.CertDiff.Added {
+		s[path.Join(cd.Sender, elem.Cert.SerialNumber.String())] = elem
+	}
+}
+
+// byDomain picks, for every name covered by a held certificate, the one
+// which stays valid the longest.
+func (s certSet) byDomain() map[string]aggregator.CertPackage {
+	best := make(map[string]aggregator.CertPackage)
+	for _, cp := range s {
+		for _, domain := range cp.Domains() {
+			if cur, ok := best[domain]; !ok || cp.Cert.NotAfter.After(cur.Cert.NotAfter) {
+				best[domain] = cp
+			}
+		}
+	}
+	return best
+}
+
+// byCommonName picks one certificate per primary name, preferring the one
+// which stays valid the longest.
+func (s certSet) byCommonName() map[string]aggregator.CertPackage {
+	best := make(map[string]aggregator.CertPackage)
+	for _, cp := range s {
+		domains := cp.Domains()
+		if len(domains) == 0 {
+			continue
+		}
+		if cur, ok := best[domains[0]]; !ok || cp.Cert.NotAfter.After(cur.Cert.NotAfter) {
+			best[domains[0]] = cp
+		}
+	}
+	return best
+}
+
+// withChanges returns a copy of the set with the changes applied, leaving
+// the set itself alone.
+func (s certSet) withChanges(changes []aggregator.CertStoreChange) certSet {
+	ret := make(certSet, len(s))
+	for key, cp := range s {
+		ret[key] = cp
+	}
+	for _, cd := range changes {
+		ret.apply(cd)
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]aggregator.CertPackage) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package exporters
+
+import (
+	"context"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/tracing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Every envoy is served the same set of secrets, so all nodes share one snapshot.
+type sdsNodeHash struct{}
+
+func (sdsNodeHash) ID(node *core.Node) string {
+	return ""
+}
+
+type EnvoySdsExportClient struct {
+	name    string
+	log     *logging.Logger
+	config  config.ClientConfiguration
+	certs   certSet
+	cache   cache.SnapshotCache
+	version int
+	listen  string
+	tls     *cryptotls.Config
+}
+
+func NewEnvoySdsExportClient(name string) *EnvoySdsExportClient {
+	v := EnvoySdsExportClient{
+		name:  name,
+		log:   logging.Client(clients.KindExporter, name),
+		certs: make(certSet),
+		cache: cache.NewSnapshotCache(false, sdsNodeHash{}, nil),
+	}
+	return &v
+}
+
+func (v *EnvoySdsExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
+	lis, err := v.listener()
+	if err != nil {
+		return err
+	}
+
+	var opts []grpc.ServerOption
+	if v.tls != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(v.tls)))
+	}
+	grpcServer := grpc.NewServer(opts...)
+	secretservice.RegisterSecretDiscoveryServiceServer(grpcServer, server.NewServer(*ctx, v.cache, nil))
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { serveErr <- err }()
+		defer clients.Recover(&err)
+		err = grpcServer.Serve(lis)
+	}()
+	defer grpcServer.Stop()
+	v.log.Info("SDS server listening", "addr", lis.Addr())
+
+	for {
+		var cd aggregator.CertStoreChange
+		var ok bool
+		select {
+		case cd, ok = <-ch:
+			if !ok {
+				return nil
+			}
+			applyCtx, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
+			v.certs.apply(cd)
+			err := v.updateSnapshot(applyCtx)
+			if err != nil {
+				v.log.Error("Could not update SDS snapshot", "sender", cd.Sender, "error", err)
+				metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+				tracing.RecordError(span, err)
+			}
+			aggregator.MarkApplied(v.GetInfo().Name)
+			span.End()
+		case err := <-serveErr:
+			return err
+		case <-(*ctx).Done():
+			return errors.New("context cancelled")
+		}
+	}
+}
+
+// listener listens on a unix socket for unix:/path, and on TCP otherwise.
+// Private keys are served as they are, so serving them over plain TCP
+// beyond the loopback interface is warned about.
+func (v *EnvoySdsExportClient) listener() (net.Listener, error) {
+	if strings.HasPrefix(v.listen, "unix:") {
+		socket := strings.TrimPrefix(strings.TrimPrefix(v.listen, "unix:"), "//")
+		if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(socket)
+		}
+		lis, err := net.Listen("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		return lis, os.Chmod(socket, 0660)
+	}
+
+	if v.tls == nil {
+		host, _, _ := net.SplitHostPort(v.listen)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			v.log.Warn("SDS serves private keys without TLS on a non-loopback address, set tlsCert and tlsKey or listen on a unix socket", "addr", v.listen)
+		}
+	}
+	return net.Listen("tcp", v.listen)
+}
+
+func (v *EnvoySdsExportClient) updateSnapshot(ctx context.Context) error {
+	var secrets []types.Resource
+	for domain, cp := range v.certs.byDomain() {
+		secrets = append(secrets, &tls.Secret{
+			Name: domain,
+			Type: &tls.Secret_TlsCertificate{
+				TlsCertificate: &tls.TlsCertificate{
+					CertificateChain: &core.DataSource{
+						Specifier: &core.DataSource_InlineBytes{InlineBytes: cp.ChainPEM()},
+					},
+					PrivateKey: &core.DataSource{
+						Specifier: &core.DataSource_InlineBytes{InlineBytes: cp.KeyPEM()},
+					},
+				},
+			},
+		})
+	}
+
+	v.version++
+	snapshot, err := cache.NewSnapshot(strconv.Itoa(v.version), map[resource.Type][]types.Resource{
+		resource.SecretType: secrets,
+	})
+	if err != nil {
+		return err
+	}
+	v.log.Info("Serving secrets over SDS", "secrets", len(secrets), "version", v.version)
+	return v.cache.SetSnapshot(ctx, "", snapshot)
+}
+
+// Plan lists the secrets which would be served differently. Envoy is served
+// from memory, so this is relative to what this process serves right now.
+func (v *EnvoySdsExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	var steps []clients.PlanStep
+	cur := v.certs.byDomain()
+	next := v.certs.withChanges(changes).byDomain()
+	for _, domain := range sortedKeys(next) {
+		cp := next[domain]
+		old, ok := cur[domain]
+		switch {
+		case !ok:
+			steps = append(steps, clients.PlanStep{Action: clients.PlanCreate, Target: "sds secret " + domain, Detail: "serial " + cp.Cert.SerialNumber.String()})
+		case !old.Cert.Equal(cp.Cert):
+			steps = append(steps, clients.PlanStep{Action: clients.PlanUpdate, Target: "sds secret " + domain, Detail: "serial " + cp.Cert.SerialNumber.String()})
+		}
+	}
+	for _, domain := range sortedKeys(cur) {
+		if _, ok := next[domain]; !ok {
+			steps = append(steps, clients.PlanStep{Action: clients.PlanDelete, Target: "sds secret " + domain})
+		}
+	}
+	return steps, nil
+}
+
+func (v *EnvoySdsExportClient) Configure(cc config.ClientConfiguration) error {
+	v.config = cc
+	v.listen = v.config["listen"]
+	v.tls = nil
+	if v.config["tlsCert"] == "" && v.config["tlsKey"] == "" {
+		if v.config["clientCA"] != "" {
+			return errors.New("clientCA needs tlsCert and tlsKey")
+		}
+		return nil
+	}
+	if strings.HasPrefix(v.listen, "unix:") {
+		return errors.New("TLS can not be used on a unix socket")
+	}
+
+	cert, err := cryptotls.LoadX509KeyPair(v.config["tlsCert"], v.config["tlsKey"])
+	if err != nil {
+		return err
+	}
+	v.tls = &cryptotls.Config{Certificates: []cryptotls.Certificate{cert}, MinVersion: cryptotls.VersionTLS12}
+	if caFile := v.config["clientCA"]; caFile != "" {
+		raw, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return fmt.Errorf("no certificates found in \"%s\"", caFile)
+		}
+		v.tls.ClientCAs = pool
+		v.tls.ClientAuth = cryptotls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+func (v *EnvoySdsExportClient) GetInfo() config.ClientInfo {
+	return config.ClientInfo{
+		Name: v.name,
+		Type: "sds",
+		Schema: []config.ConfigKey{
+			{Key: "listen", Type: config.TypeString, Default: "127.0.0.1:18000", Description: "address the SDS gRPC server listens on, or unix:/path for a unix socket"},
+			{Key: "tlsCert", Type: config.TypeString, Description: "certificate file to serve SDS over TLS with"},
+			{Key: "tlsKey", Type: config.TypeString, Description: "key file of tlsCert"},
+			{Key: "clientCA", Type: config.TypeString, Description: "CA file client certificates have to be issued by, for mutual TLS"},
+			config.LeaderOnlyKey(false),
+		},
+	}
+}
@@ -0,0 +1,163 @@
+package exporters
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients/config"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func testCertPackage(t *testing.T, domain string, ips ...net.IP) aggregator.CertPackage {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aggregator.CertPackage{Cert: cert, Chain: []*x509.Certificate{cert}, Key: key}
+}
+
+// startSds runs the exporter with the given settings and hands it one
+// certificate.
+func startSds(t *testing.T, cc config.ClientConfiguration, cp aggregator.CertPackage) {
+	v := NewEnvoySdsExportClient("sds")
+	if err := v.Configure(cc); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan aggregator.CertStoreChange, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Start(&ctx, ch)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	ch <- aggregator.CertStoreChange{Sender: "test", CertDiff: aggregator.CertDiff{Added: []aggregator.CertPackage{cp}}}
+}
+
+// fetchSecret asks for a secret the way Envoy does, retrying until the
+// server is up and serves it.
+func fetchSecret(t *testing.T, target string, creds credentials.TransportCredentials, name string) *tls.Secret {
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := secretservice.NewSecretDiscoveryServiceClient(conn)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := client.FetchSecrets(ctx, &discovery.DiscoveryRequest{
+			Node:          &core.Node{Id: "envoy-test"},
+			ResourceNames: []string{name},
+			TypeUrl:       resource.SecretType,
+		})
+		cancel()
+		if err == nil && len(resp.Resources) == 1 {
+			var secret tls.Secret
+			if err := resp.Resources[0].UnmarshalTo(&secret); err != nil {
+				t.Fatal(err)
+			}
+			return &secret
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("could not fetch secret %s: %v", name, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func checkSecret(t *testing.T, secret *tls.Secret, cp aggregator.CertPackage) {
+	tc := secret.GetTlsCertificate()
+	if tc == nil {
+		t.Fatalf("secret %s holds no TLS certificate", secret.Name)
+	}
+	if got := string(tc.CertificateChain.GetInlineBytes()); got != string(cp.ChainPEM()) {
+		t.Errorf("served chain differs:\n%s", got)
+	}
+	keyPEM := tc.PrivateKey.GetInlineBytes()
+	if block, _ := pem.Decode(keyPEM); block == nil || block.Type != "EC PRIVATE KEY" {
+		t.Fatalf("served key is not an EC private key:\n%s", keyPEM)
+	}
+	if _, err := cryptotls.X509KeyPair(tc.CertificateChain.GetInlineBytes(), keyPEM); err != nil {
+		t.Errorf("served key does not match the chain: %s", err)
+	}
+}
+
+func TestSdsServesOverUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "sds.sock")
+	cp := testCertPackage(t, "a.example.com")
+	startSds(t, config.ClientConfiguration{"listen": "unix:" + socket}, cp)
+
+	secret := fetchSecret(t, "unix:"+socket, insecure.NewCredentials(), "a.example.com")
+	checkSecret(t, secret, cp)
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("expected the socket to have mode 0660, got %v (%v)", fi.Mode().Perm(), err)
+	}
+}
+
+func TestSdsServesOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	server := testCertPackage(t, "sds.example.com", net.ParseIP("127.0.0.1"))
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, server.ChainPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, server.KeyPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	cp := testCertPackage(t, "b.example.com")
+	startSds(t, config.ClientConfiguration{"listen": addr, "tlsCert": certFile, "tlsKey": keyFile}, cp)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Cert)
+	secret := fetchSecret(t, addr, credentials.NewTLS(&cryptotls.Config{RootCAs: roots}), "b.example.com")
+	checkSecret(t, secret, cp)
+}
@@ -0,0 +1,417 @@
+package exporters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/encryption"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/tracing"
+	"traefik-cert-aggregator/util"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type execPathData struct {
+	CommonName string
+	Sender     string
+	Serial     string
+}
+
+// execFile is a file the exporter writes, and the certificate it holds.
+type execFile struct {
+	cp  aggregator.CertPackage
+	key bool
+}
+
+type ExecExportClient struct {
+	name         string
+	log          *logging.Logger
+	config       config.ClientConfiguration
+	basePath     string
+	certTemplate *template.Template
+	keyTemplate  *template.Template
+	command      string
+	timeout      time.Duration
+	retries      int
+	domains      []string
+	keySource    encryption.KeySource
+	certs        certSet
+	// onDisk holds, per written path, the certificate last written to it
+	onDisk map[string][]byte
+}
+
+func NewExecExportClient(name string) *ExecExportClient {
+	v := ExecExportClient{
+		name:   name,
+		log:    logging.Client(clients.KindExporter, name),
+		certs:  make(certSet),
+		onDisk: make(map[string][]byte),
+	}
+	return &v
+}
+
+func (v *ExecExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
+	// A started exporter is sent everything again
+	v.certs = make(certSet)
+	v.onDisk = make(map[string][]byte)
+	for {
+		var cd aggregator.CertStoreChange
+		var ok bool
+		select {
+		case cd, ok = <-ch:
+			if !ok {
+				return nil
+			}
+			applyCtx, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
+			v.certs.apply(cd)
+			files := v.files(v.certs)
+			synced := make(map[string]bool)
+			var added, removed []string
+			for _, elem := range cd.CertDiff.Added {
+				certPath, keyPath, err := v.paths(cd.Sender, elem)
+				if err != nil {
+					v.log.Error("Could not render paths", "sender", cd.Sender, "domain", elem.Cert.Subject.CommonName, "serial", elem.Cert.SerialNumber.String(), "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
+					continue
+				}
+				changed, err := v.syncPaths(applyCtx, files, synced, certPath, keyPath)
+				if err != nil {
+					v.log.Error("Could not write certificate", "sender", cd.Sender, "domain", elem.Cert.Subject.CommonName, "serial", elem.Cert.SerialNumber.String(), "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
+					continue
+				}
+				// An older certificate for a path a newer one holds changes nothing
+				if changed {
+					added = append(added, elem.Domains()...)
+				}
+			}
+
+			for _, elem := range cd.CertDiff.Removed {
+				removed = append(removed, elem.Domains()...)
+				certPath, keyPath, err := v.paths(cd.Sender, elem)
+				if err != nil {
+					continue
+				}
+				if _, err := v.syncPaths(applyCtx, files, synced, certPath, keyPath); err != nil {
+					v.log.Error("Could not replace stale file", "sender", cd.Sender, "domain", elem.Cert.Subject.CommonName, "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
+				}
+			}
+
+			all := append(append([]string{}, added...), removed...)
+			if v.command != "" && len(all) > 0 && (len(v.domains) == 0 || util.MatchAnyDomain(v.domains, all)) {
+				v.runHook(applyCtx, []string{
+					"CERT_AGG_SENDER=" + cd.Sender,
+					"CERT_AGG_BASE=" + v.basePath,
+					"CERT_AGG_ADDED=" + strings.Join(added, " "),
+					"CERT_AGG_REMOVED=" + strings.Join(removed, " "),
+					"CERT_AGG_DOMAINS=" + strings.Join(sortedDomains(all), " "),
+				})
+			}
+			aggregator.MarkApplied(v.GetInfo().Name)
+			span.End()
+		case <-(*ctx).Done():
+			return errors.New("context cancelled")
+		}
+	}
+}
+
+func (v *ExecExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	var steps []clients.PlanStep
+	planFile := func(name string, data []byte, detail string) error {
+		cur, err := ioutil.ReadFile(name)
+		switch {
+		case os.IsNotExist(err):
+			steps = append(steps, clients.PlanStep{Action: clients.PlanCreate, Target: name, Detail: detail})
+		case err != nil:
+			return err
+		case data == nil || !bytes.Equal(cur, data):
+			steps = append(steps, clients.PlanStep{Action: clients.PlanUpdate, Target: name, Detail: detail})
+		}
+		return nil
+	}
+
+	for i, cd := range changes {
+		files := v.files(v.certs.withChanges(changes[:i+1]))
+		planned := make(map[string]bool)
+		// planPaths plans what syncPaths would do to the given paths
+		planPaths := func(detail string, paths ...string) error {
+			for _, p := range paths {
+				if planned[p] {
+					continue
+				}
+				planned[p] = true
+				f, ok := files[p]
+				if !ok {
+					if _, err := os.Stat(p); err == nil {
+						steps = append(steps, clients.PlanStep{Action: clients.PlanDelete, Target: p, Detail: detail})
+					}
+					continue
+				}
+				data := f.cp.ChainPEM()
+				if f.key {
+					// Encrypted keys differ on every write, so they are always written
+					data = nil
+					if v.keySource == nil {
+						data = f.cp.KeyPEM()
+					}
+				}
+				if err := planFile(p, data, f.cp.Cert.Subject.CommonName); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var added, removed []string
+		for _, elem := range cd.CertDiff.Added {
+			certPath, keyPath, err := v.paths(cd.Sender, elem)
+			if err != nil {
+				return nil, err
+			}
+			if err := planPaths(elem.Cert.Subject.CommonName, certPath, keyPath); err != nil {
+				return nil, err
+			}
+			added = append(added, elem.Domains()...)
+		}
+
+		for _, elem := range cd.CertDiff.Removed {
+			removed = append(removed, elem.Domains()...)
+			certPath, keyPath, err := v.paths(cd.Sender, elem)
+			if err != nil {
+				continue
+			}
+			if err := planPaths(elem.Cert.Subject.CommonName, certPath, keyPath); err != nil {
+				return nil, err
+			}
+		}
+
+		all := append(append([]string{}, added...), removed...)
+		if v.command != "" && len(all) > 0 && (len(v.domains) == 0 || util.MatchAnyDomain(v.domains, all)) {
+			steps = append(steps, clients.PlanStep{
+				Action: clients.PlanRun,
+				Target: v.command,
+				Detail: "CERT_AGG_DOMAINS=" + strings.Join(sortedDomains(all), " "),
+			})
+		}
+	}
+	return steps, nil
+}
+
+func (v *ExecExportClient) paths(sender string, cp aggregator.CertPackage) (string, string, error) {
+	data := execPathData{
+		CommonName: cp.Cert.Subject.CommonName,
+		Sender:     sender,
+		Serial:     cp.Cert.SerialNumber.String(),
+	}
+	var certPath, keyPath bytes.Buffer
+	if err := v.certTemplate.Execute(&certPath, data); err != nil {
+		return "", "", err
+	}
+	if err := v.keyTemplate.Execute(&keyPath, data); err != nil {
+		return "", "", err
+	}
+	certFile, keyFile := path.Join(v.basePath, certPath.String()), path.Join(v.basePath, keyPath.String())
+	// Names come from certificates, which must not reach outside the directory
+	for _, name := range []string{certFile, keyFile} {
+		if !strings.HasPrefix(name, strings.TrimSuffix(v.basePath, "/")+"/") {
+			return "", "", fmt.Errorf("path \"%s\" is outside of %s", name, v.basePath)
+		}
+	}
+	return certFile, keyFile, nil
+}
+
+// files renders the paths of every certificate in a set. Where several
+// render to the same path, the one which stays valid the longest wins.
+func (v *ExecExportClient) files(s certSet) map[string]execFile {
+	files := make(map[string]execFile)
+	for key, cp := range s {
+		certPath, keyPath, err := v.paths(path.Dir(key), cp)
+		if err != nil {
+			continue
+		}
+		for _, f := range []struct {
+			name string
+			key  bool
+		}{{certPath, false}, {keyPath, true}} {
+			if cur, ok := files[f.name]; !ok || cp.Cert.NotAfter.After(cur.cp.Cert.NotAfter) {
+				files[f.name] = execFile{cp: cp, key: f.key}
+			}
+		}
+	}
+	return files
+}
+
+// syncPaths brings the given paths in line with the certificates chosen for
+// them: the chosen one is written unless it already is on disk, and a path
+// no certificate renders to any more is removed. It reports whether a file
+// changed.
+func (v *ExecExportClient) syncPaths(ctx context.Context, files map[string]execFile, synced map[string]bool, paths ...string) (bool, error) {
+	changed := false
+	for _, p := range paths {
+		if synced[p] {
+			continue
+		}
+		synced[p] = true
+		f, ok := files[p]
+		if !ok {
+			delete(v.onDisk, p)
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return changed, err
+			}
+			changed = true
+			continue
+		}
+		if cur, ok := v.onDisk[p]; ok && bytes.Equal(cur, f.cp.Cert.Raw) {
+			continue
+		}
+		var err error
+		if f.key {
+			err = v.writeKey(ctx, p, f.cp)
+		} else {
+			err = writeFile(p, f.cp.ChainPEM(), 0644)
+		}
+		if err != nil {
+			// Written again on the next change touching it
+			delete(v.onDisk, p)
+			return changed, err
+		}
+		v.onDisk[p] = f.cp.Cert.Raw
+		changed = true
+	}
+	return changed, nil
+}
+
+func sortedDomains(domains []string) []string {
+	ret := util.NewSetFromArray(domains).GetItems()
+	sort.Strings(ret)
+	return ret
+}
+
+func (v *ExecExportClient) runHook(ctx context.Context, env []string) {
+	ctx, span := tracing.Tracer().Start(ctx, "exec.hook")
+	defer span.End()
+	for attempt := 1; attempt <= v.retries+1; attempt++ {
+		cmdCtx, cancel := context.WithTimeout(ctx, v.timeout)
+		cmd := exec.CommandContext(cmdCtx, "/bin/sh", "-c", v.command)
+		cmd.Env = append(os.Environ(), env...)
+		output, err := cmd.CombinedOutput()
+		cancel()
+
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			v.log.Info("Hook output", "line", scanner.Text())
+		}
+		if err == nil {
+			return
+		}
+		v.log.Warn("Hook failed", "attempt", attempt, "attempts", v.retries+1, "error", err)
+		metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+		tracing.RecordError(span, err)
+		if attempt == v.retries+1 {
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (v *ExecExportClient) writeKey(ctx context.Context, name string, cp aggregator.CertPackage) error {
+	key := cp.KeyPEM()
+	if v.keySource != nil {
+		var err error
+		key, err = encryption.Seal(ctx, v.keySource, key)
+		if err != nil {
+			return err
+		}
+	}
+	return writeFile(name, key, 0600)
+}
+
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	err := os.MkdirAll(path.Dir(name), 0711)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (v *ExecExportClient) Configure(cc config.ClientConfiguration) error {
+	v.config = cc
+	v.basePath = path.Clean(v.config["baseLocation"])
+	v.command = v.config["command"]
+
+	var err error
+	v.certTemplate, err = template.New("cert").Parse(v.config["certTemplate"])
+	if err != nil {
+		return err
+	}
+	v.keyTemplate, err = template.New("key").Parse(v.config["keyTemplate"])
+	if err != nil {
+		return err
+	}
+
+	v.timeout, err = v.config.GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	v.retries, err = v.config.GetInt("retries")
+	if err != nil {
+		return err
+	}
+
+	v.keySource = nil
+	encryptKeys, err := v.config.GetBool("encryptKeys")
+	if err != nil {
+		return err
+	}
+	if encryptKeys {
+		v.keySource = encryption.Default()
+		if v.keySource == nil {
+			return errors.New("encryptKeys is set but no key encryption is configured")
+		}
+	}
+
+	v.domains = v.config.GetList("domains")
+	return nil
+}
+
+func (v *ExecExportClient) GetInfo() config.ClientInfo {
+	return config.ClientInfo{
+		Name: v.name,
+		Type: "exec",
+		Schema: []config.ConfigKey{
+			{Key: "baseLocation", Type: config.TypeString, Default: os.TempDir(), Description: "directory templated paths are relative to"},
+			{Key: "certTemplate", Type: config.TypeString, Default: "{{.CommonName}}/fullchain.pem", Description: "path template for the certificate chain, with .CommonName, .Sender and .Serial"},
+			{Key: "keyTemplate", Type: config.TypeString, Default: "{{.CommonName}}/privkey.pem", Description: "path template for the private key"},
+			{Key: "command", Type: config.TypeString, Description: "shell command to run after certificates changed"},
+			{Key: "timeout", Type: config.TypeDuration, Default: "30s", Description: "how long the command may run"},
+			{Key: "retries", Type: config.TypeInt, Default: "3", Description: "how often a failed command is retried"},
+			{Key: "domains", Type: config.TypeList, Description: "domain globs, the command only runs when one of them changed"},
+			{Key: "encryptKeys", Type: config.TypeBool, Default: "false", Description: "encrypt private keys with the configured key encryption"},
+			config.LeaderOnlyKey(false),
+		},
+	}
+}
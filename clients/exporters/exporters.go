@@ -7,6 +7,11 @@ import (
 
 func AddAllClients(cfg config.Config) {
 	//Configuration is provided here.
-	clients.AddExportClient(NewStdoutExportClient())
-	clients.AddExportClient(NewTraefikExportClient())
+	clients.AddExportClient("stdout", NewStdoutExportClient)
+	clients.AddExportClient("traefik", NewTraefikExportClient)
+	clients.AddExportClient("sds", NewEnvoySdsExportClient)
+	clients.AddExportClient("kubernetes", NewKubernetesExportClient)
+	clients.AddExportClient("vault", NewVaultExportClient)
+	clients.AddExportClient("exec", NewExecExportClient)
+	clients.AddExportClient("webhook", NewWebhookExportClient)
 }
@@ -0,0 +1,287 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	KubernetesManagedByLabel = "app.kubernetes.io/managed-by"
+	KubernetesManagedByValue = "traefik-cert-aggregator"
+)
+
+var invalidSecretNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+type KubernetesExportClient struct {
+	name       string
+	log        *logging.Logger
+	config     config.ClientConfiguration
+	client     kubernetes.Interface
+	certs      certSet
+	namespaces []string
+	prefix     string
+}
+
+func NewKubernetesExportClient(name string) *KubernetesExportClient {
+	v := KubernetesExportClient{
+		name:  name,
+		log:   logging.Client(clients.KindExporter, name),
+		certs: make(certSet),
+	}
+	return &v
+}
+
+func (v *KubernetesExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
+	for {
+		var cd aggregator.CertStoreChange
+		var ok bool
+		select {
+		case cd, ok = <-ch:
+			if !ok {
+				return nil
+			}
+			applyCtx, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
+			v.certs.apply(cd)
+			for _, ns := range v.namespaces {
+				err := v.reconcile(applyCtx, ns)
+				if err != nil {
+					v.log.Error("Could not sync secrets", "namespace", ns, "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
+				}
+			}
+			aggregator.MarkApplied(v.GetInfo().Name)
+			span.End()
+		case <-(*ctx).Done():
+			return errors.New("context cancelled")
+		}
+	}
+}
+
+// Longest name of a Kubernetes object
+const maxSecretNameLength = 253
+
+// secretName returns the name of the secret for a domain. A name which had to
+// be changed to be valid, as for a wildcard, or shortened gets a hash of the
+// domain appended, so it can't clash with the name of another domain.
+func (v *KubernetesExportClient) secretName(domain string) string {
+	domain = strings.ToLower(domain)
+	name := strings.Replace(domain, "*", "wildcard", 1)
+	name = strings.Trim(v.prefix+invalidSecretNameChars.ReplaceAllString(name, "-"), "-.")
+	if name == v.prefix+domain && len(name) <= maxSecretNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(domain))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	if len(name) > maxSecretNameLength-len(suffix) {
+		name = strings.TrimRight(name[:maxSecretNameLength-len(suffix)], "-.")
+	}
+	return name + suffix
+}
+
+func (v *KubernetesExportClient) desiredSecrets(certs certSet, ns string) map[string]*corev1.Secret {
+	desired := make(map[string]*corev1.Secret)
+	for domain, cp := range certs.byCommonName() {
+		name := v.secretName(domain)
+		desired[name] = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+				Labels: map[string]string{
+					KubernetesManagedByLabel: KubernetesManagedByValue,
+				},
+				Annotations: map[string]string{
+					"cert-agg/domains": strings.Join(cp.Domains(), ","),
+					"cert-agg/serial":  cp.Cert.SerialNumber.String(),
+				},
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       cp.ChainPEM(),
+				corev1.TLSPrivateKeyKey: cp.KeyPEM(),
+			},
+		}
+	}
+	return desired
+}
+
+// ownedSecrets returns the secrets created by the aggregator, by name.
+func (v *KubernetesExportClient) ownedSecrets(ctx context.Context, ns string) (map[string]corev1.Secret, error) {
+	owned, err := v.client.CoreV1().Secrets(ns).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", KubernetesManagedByLabel, KubernetesManagedByValue),
+	})
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]corev1.Secret)
+	for _, secret := range owned.Items {
+		existing[secret.Name] = secret
+	}
+	return existing, nil
+}
+
+func secretUnchanged(cur corev1.Secret, secret *corev1.Secret) bool {
+	return bytes.Equal(cur.Data[corev1.TLSCertKey], secret.Data[corev1.TLSCertKey]) &&
+		bytes.Equal(cur.Data[corev1.TLSPrivateKeyKey], secret.Data[corev1.TLSPrivateKeyKey])
+}
+
+func (v *KubernetesExportClient) reconcile(ctx context.Context, ns string) error {
+	secrets := v.client.CoreV1().Secrets(ns)
+	existing, err := v.ownedSecrets(ctx, ns)
+	if err != nil {
+		return err
+	}
+
+	desired := v.desiredSecrets(v.certs, ns)
+	for name, secret := range desired {
+		cur, ok := existing[name]
+		if ok {
+			if secretUnchanged(cur, secret) {
+				continue
+			}
+			secret.ResourceVersion = cur.ResourceVersion
+			_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+			if err != nil {
+				v.log.Error("Could not update secret", "namespace", ns, "name", name, "domain", secret.Annotations["cert-agg/domains"], "serial", secret.Annotations["cert-agg/serial"], "error", err)
+				metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+				continue
+			}
+			v.log.Info("Updated secret", "namespace", ns, "name", name, "domain", secret.Annotations["cert-agg/domains"], "serial", secret.Annotations["cert-agg/serial"])
+			continue
+		}
+
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			v.log.Warn("Secret exists and is not managed by the aggregator, leaving it alone", "namespace", ns, "name", name)
+			continue
+		}
+		if err != nil {
+			v.log.Error("Could not create secret", "namespace", ns, "name", name, "domain", secret.Annotations["cert-agg/domains"], "serial", secret.Annotations["cert-agg/serial"], "error", err)
+			metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+			continue
+		}
+		v.log.Info("Created secret", "namespace", ns, "name", name, "domain", secret.Annotations["cert-agg/domains"], "serial", secret.Annotations["cert-agg/serial"])
+	}
+
+	for name := range existing {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		err = secrets.Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			v.log.Error("Could not delete stale secret", "namespace", ns, "name", name, "error", err)
+			metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+			continue
+		}
+		v.log.Info("Deleted stale secret", "namespace", ns, "name", name)
+	}
+	return nil
+}
+
+func (v *KubernetesExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	var steps []clients.PlanStep
+	certs := v.certs.withChanges(changes)
+	for _, ns := range v.namespaces {
+		existing, err := v.ownedSecrets(ctx, ns)
+		if err != nil {
+			return nil, err
+		}
+		desired := v.desiredSecrets(certs, ns)
+		var names []string
+		for name := range desired {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			secret := desired[name]
+			target := fmt.Sprintf("secret %s/%s", ns, name)
+			detail := "serial " + secret.Annotations["cert-agg/serial"]
+			cur, ok := existing[name]
+			if ok {
+				if !secretUnchanged(cur, secret) {
+					steps = append(steps, clients.PlanStep{Action: clients.PlanUpdate, Target: target, Detail: detail})
+				}
+				continue
+			}
+			_, err := v.client.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+			if err == nil {
+				steps = append(steps, clients.PlanStep{Action: clients.PlanSkip, Target: target, Detail: "exists and is not managed by the aggregator"})
+				continue
+			}
+			if !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+			steps = append(steps, clients.PlanStep{Action: clients.PlanCreate, Target: target, Detail: detail})
+		}
+		var stale []string
+		for name := range existing {
+			if _, ok := desired[name]; !ok {
+				stale = append(stale, name)
+			}
+		}
+		sort.Strings(stale)
+		for _, name := range stale {
+			steps = append(steps, clients.PlanStep{Action: clients.PlanDelete, Target: fmt.Sprintf("secret %s/%s", ns, name)})
+		}
+	}
+	return steps, nil
+}
+
+func (v *KubernetesExportClient) Configure(cc config.ClientConfiguration) error {
+	v.config = cc
+	v.prefix = v.config["secretPrefix"]
+	v.namespaces = v.config.GetList("namespaces")
+
+	var restConfig *rest.Config
+	var err error
+	if kubeconfig := v.config["kubeconfig"]; kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	v.client = client
+	return nil
+}
+
+func (v *KubernetesExportClient) GetInfo() config.ClientInfo {
+	return config.ClientInfo{
+		Name: v.name,
+		Type: "kubernetes",
+		Schema: []config.ConfigKey{
+			{Key: "kubeconfig", Type: config.TypeString, Description: "path to a kubeconfig, in-cluster credentials are used when empty"},
+			{Key: "namespaces", Type: config.TypeList, Default: "default", Description: "namespaces to write secrets to"},
+			{Key: "secretPrefix", Type: config.TypeString, Description: "prefix for the names of created secrets"},
+			config.LeaderOnlyKey(true),
+		},
+	}
+}
@@ -0,0 +1,106 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"traefik-cert-aggregator/aggregator"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestKubernetes(objects ...corev1.Secret) *KubernetesExportClient {
+	v := NewKubernetesExportClient("kubernetes")
+	client := fake.NewSimpleClientset()
+	for i := range objects {
+		client.Tracker().Add(&objects[i])
+	}
+	v.client = client
+	v.namespaces = []string{"default"}
+	v.prefix = "tls-"
+	return v
+}
+
+// applyKubernetes hands the exporter a change and syncs its secrets.
+func applyKubernetes(t *testing.T, v *KubernetesExportClient, cd aggregator.CertStoreChange) {
+	v.certs.apply(cd)
+	if err := v.reconcile(context.Background(), "default"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getSecret(t *testing.T, v *KubernetesExportClient, name string) *corev1.Secret {
+	secret, err := v.client.CoreV1().Secrets("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("secret %s: %s", name, err)
+	}
+	return secret
+}
+
+func TestKubernetesSyncsSecrets(t *testing.T) {
+	unmanaged := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tls-b.example.com", Namespace: "default"},
+		Data:       map[string][]byte{corev1.TLSCertKey: []byte("theirs")},
+	}
+	v := newTestKubernetes(unmanaged)
+	a := testCertPackage(t, "a.example.com")
+	b := testCertPackage(t, "b.example.com")
+
+	// Created, but an existing secret of someone else is left alone
+	applyKubernetes(t, v, added("vault", a, b))
+	secret := getSecret(t, v, "tls-a.example.com")
+	if secret.Type != corev1.SecretTypeTLS || !bytes.Equal(secret.Data[corev1.TLSCertKey], a.ChainPEM()) || !bytes.Equal(secret.Data[corev1.TLSPrivateKeyKey], a.KeyPEM()) {
+		t.Errorf("unexpected secret %+v", secret)
+	}
+	if secret.Labels[KubernetesManagedByLabel] != KubernetesManagedByValue {
+		t.Errorf("secret is not labelled as managed: %v", secret.Labels)
+	}
+	if secret := getSecret(t, v, "tls-b.example.com"); string(secret.Data[corev1.TLSCertKey]) != "theirs" {
+		t.Error("unmanaged secret was overwritten")
+	}
+
+	// Updated on renewal
+	renewed := testCertPackage(t, "a.example.com")
+	applyKubernetes(t, v, aggregator.CertStoreChange{Sender: "vault", CertDiff: aggregator.CertDiff{Added: []aggregator.CertPackage{renewed}, Removed: []aggregator.CertPackage{a}}})
+	secret = getSecret(t, v, "tls-a.example.com")
+	if !bytes.Equal(secret.Data[corev1.TLSCertKey], renewed.ChainPEM()) || secret.Annotations["cert-agg/serial"] != renewed.Cert.SerialNumber.String() {
+		t.Error("secret was not updated to the renewed certificate")
+	}
+
+	// Deleted once no longer held, the unmanaged secret is kept
+	applyKubernetes(t, v, aggregator.CertStoreChange{Sender: "vault", CertDiff: aggregator.CertDiff{Removed: []aggregator.CertPackage{renewed, b}}})
+	list, err := v.client.CoreV1().Secrets("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "tls-b.example.com" {
+		t.Errorf("expected only the unmanaged secret to be left, got %d secrets", len(list.Items))
+	}
+}
+
+func TestKubernetesSecretNames(t *testing.T) {
+	v := newTestKubernetes()
+	wildcard := v.secretName("*.example.com")
+	plain := v.secretName("wildcard.example.com")
+	if wildcard == plain {
+		t.Errorf("*.example.com and wildcard.example.com share the name %s", plain)
+	}
+	if plain != "tls-wildcard.example.com" {
+		t.Errorf("unexpected name %s", plain)
+	}
+	if !strings.HasPrefix(wildcard, "tls-wildcard.example.com-") {
+		t.Errorf("unexpected name %s", wildcard)
+	}
+
+	long := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 61) + ".com"
+	name := v.secretName(long)
+	if len(name) > 253 {
+		t.Errorf("name is %d characters long", len(name))
+	}
+	if name == v.secretName(long[:len(long)-4]+".net") {
+		t.Error("truncated names of different domains clash")
+	}
+}
@@ -3,36 +3,81 @@ package exporters
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"strings"
 	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
 	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type StdoutExportClient struct {
+	name   string
+	log    *logging.Logger
 	config config.ClientConfiguration
 }
 
-func NewStdoutExportClient() *StdoutExportClient {
-	v := StdoutExportClient{}
+func NewStdoutExportClient(name string) *StdoutExportClient {
+	v := StdoutExportClient{
+		name: name,
+		log:  logging.Client(clients.KindExporter, name),
+	}
 	return &v
 }
 
 func (v *StdoutExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
 	for {
 		var cd aggregator.CertStoreChange
+		var ok bool
 		var prefix = ""
 		if val, ok := v.config["prefix"]; ok {
 			prefix = val
 		}
 		select {
-		case cd = <-ch:
-			log.Printf("%sGot %d additions, %d removals from store \"%s\"", prefix, len(cd.CertDiff.Added), len(cd.CertDiff.Removed), cd.Sender)
+		case cd, ok = <-ch:
+			if !ok {
+				return nil
+			}
+			_, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
+			v.log.Info(prefix+"Certificates changed", "sender", cd.Sender, "added", len(cd.CertDiff.Added), "removed", len(cd.CertDiff.Removed))
+			for _, cp := range cd.CertDiff.Added {
+				v.log.Info(prefix+"Certificate added", certFields(cd.Sender, cp)...)
+			}
+			for _, cp := range cd.CertDiff.Removed {
+				v.log.Info(prefix+"Certificate removed", certFields(cd.Sender, cp)...)
+			}
+			aggregator.MarkApplied(v.GetInfo().Name)
+			span.End()
 		case <-(*ctx).Done():
 			return errors.New("context cancelled")
 		}
 	}
 }
 
+func certFields(sender string, cp aggregator.CertPackage) []interface{} {
+	return []interface{}{
+		"sender", sender,
+		"domain", cp.Cert.Subject.CommonName,
+		"domains", strings.Join(cp.Domains(), ","),
+		"serial", cp.Cert.SerialNumber.String(),
+		"notAfter", cp.Cert.NotAfter,
+	}
+}
+
+func (v *StdoutExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	var steps []clients.PlanStep
+	for _, cd := range changes {
+		steps = append(steps, clients.PlanStep{
+			Action: clients.PlanPrint,
+			Target: "stdout",
+			Detail: fmt.Sprintf("%d additions, %d removals from store \"%s\"", len(cd.CertDiff.Added), len(cd.CertDiff.Removed), cd.Sender),
+		})
+	}
+	return steps, nil
+}
+
 func (v *StdoutExportClient) Configure(cc config.ClientConfiguration) error {
 	v.config = cc
 	return nil
@@ -40,10 +85,11 @@ func (v *StdoutExportClient) Configure(cc config.ClientConfiguration) error {
 
 func (v *StdoutExportClient) GetInfo() config.ClientInfo {
 	return config.ClientInfo{
-		Name: "stdout",
-		ConfigHelp: map[string]string{
-			"prefix": "prefix every message",
-			"baz":    "foo",
+		Name: v.name,
+		Type: "stdout",
+		Schema: []config.ConfigKey{
+			{Key: "prefix", Type: config.TypeString, Description: "prefix every message"},
+			config.LeaderOnlyKey(false),
 		},
 	}
 }
@@ -1,19 +1,26 @@
 package exporters
 
 import (
+	"bytes"
 	"context"
-	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
 	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/tracing"
+	"traefik-cert-aggregator/util"
 
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,96 +37,96 @@ type TraefikCertificateConfig struct {
 	CertFile string `yaml:"certFile"`
 }
 type TraefikExportClient struct {
+	name          string
+	log           *logging.Logger
 	config        config.ClientConfiguration
 	traefikConfig TraefikConfig
-	basePath string
+	basePath      string
 }
 
-func NewTraefikExportClient() *TraefikExportClient {
-	v := TraefikExportClient{}
+func NewTraefikExportClient(name string) *TraefikExportClient {
+	v := TraefikExportClient{
+		name: name,
+		log:  logging.Client(clients.KindExporter, name),
+	}
 	return &v
 }
 
 func (v *TraefikExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
+	traefikConfigFilePath := path.Join(v.basePath, "traefik.yaml")
+	if _, err := os.Stat(traefikConfigFilePath); os.IsNotExist(err) {
+		emptyCfgBytes, err := yaml.Marshal(TraefikConfig{})
+		if err != nil {
+			return err
+		}
+		ioutil.WriteFile(traefikConfigFilePath, emptyCfgBytes, 0600)
+	}
 
 	for {
 		var cd aggregator.CertStoreChange
+		var ok bool
 		select {
-		case cd = <-ch:
+		case cd, ok = <-ch:
+			if !ok {
+				return nil
+			}
+			_, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
 			for _, elem := range cd.CertDiff.Added {
-				newPath := path.Join(v.basePath, cd.Sender, elem.Cert.SerialNumber.String())
+				newPath := v.keyPairPath(cd.Sender, elem)
 				os.MkdirAll(newPath, 0711)
 				keyPath := path.Join(newPath, "key.pem")
-				log.Printf("Writing key and cert to %s (%s)", newPath, elem.Cert.Subject.CommonName)
+				v.log.Info("Writing key and cert", "path", newPath, "sender", cd.Sender, "domain", elem.Cert.Subject.CommonName, "serial", elem.Cert.SerialNumber.String())
 				certPath := path.Join(newPath, "cert.pem")
-				keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(elem.Key)})
-				ioutil.WriteFile(keyPath, keyPEM, 0600)
-				certStrings := make([]string, len(elem.Chain))
-				for i, cert := range elem.Chain {
-					certStrings[i] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+				keyPEM, certPEM := traefikKeyPair(elem)
+				err := ioutil.WriteFile(keyPath, keyPEM, 0600)
+				if err != nil {
+					v.log.Error("Could not write key", "path", keyPath, "domain", elem.Cert.Subject.CommonName, "serial", elem.Cert.SerialNumber.String(), "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
+				}
+				err = ioutil.WriteFile(certPath, certPEM, 0600)
+				if err != nil {
+					v.log.Error("Could not write cert", "path", certPath, "domain", elem.Cert.Subject.CommonName, "serial", elem.Cert.SerialNumber.String(), "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
 				}
-				strings.Join(certStrings, "\n")
-				ioutil.WriteFile(certPath, []byte(strings.Join(certStrings, "\n")), 0600)
 			}
 
 			for _, elem := range cd.CertDiff.Removed {
-				newPath := path.Join(v.basePath, cd.Sender, elem.Cert.SerialNumber.String())
-				err := os.RemoveAll(newPath)
+				err := os.RemoveAll(v.keyPairPath(cd.Sender, elem))
 				if err != nil {
-					log.Printf("Could not remove stale certificate: %s", err)
+					v.log.Error("Could not remove stale certificate", "sender", cd.Sender, "domain", elem.Cert.Subject.CommonName, "serial", elem.Cert.SerialNumber.String(), "error", err)
+					metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+					tracing.RecordError(span, err)
 					continue
 				}
 			}
 
-			v.traefikConfig.Tls.Certificates = v.traefikConfig.Tls.Certificates[0:]
-
-			importerFileinfo, err := ioutil.ReadDir(v.basePath)
+			keyPairs, err := v.listKeyPairs()
 			if err != nil {
-				log.Printf("could not list directory to generate config: %s", err)
+				v.log.Error("Could not list directory to generate config", "error", err)
+				metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+				tracing.RecordError(span, err)
+				aggregator.MarkApplied(v.GetInfo().Name)
+				span.End()
 				continue
 			}
+			v.traefikConfig = v.configFor(keyPairs)
 
-			for _, importerDir := range importerFileinfo {
-				if (!importerDir.IsDir()){
-					continue
-				}
-				
-				importerPath := path.Join(v.basePath, importerDir.Name())
-				fileinfo, err := ioutil.ReadDir(importerPath)
-
-				if err != nil {
-					log.Printf("could not list directory to generate config: %s", err)
-					continue
-				}
-				for _, file := range fileinfo {
-					if !file.IsDir() {
-						continue
-					}
-					keyPairPath := path.Join(importerPath, file.Name())
-					keyPath, _ := filepath.Abs(path.Join(keyPairPath, "key.pem"))
-					certPath, _ := filepath.Abs(path.Join(keyPairPath, "cert.pem"))
-					_, err1 := os.Stat(keyPath)
-					_, err2 := os.Stat(certPath)
-					if err1 != nil || err2 != nil {
-						log.Printf("Could not find key or cert file in dir: %s", keyPairPath)
-						continue
-					}
-					
-					tcc := TraefikCertificateConfig{
-						KeyFile:  keyPath,
-						CertFile: certPath,
-					}
-
-					v.traefikConfig.Tls.Certificates = append(v.traefikConfig.Tls.Certificates, tcc)
-				}
-			}
-
-			traefikConfigFilePath := path.Join(v.basePath, "traefik.yaml")
 			traefikCfgBytes, err := yaml.Marshal(v.traefikConfig)
 			if err != nil {
-				log.Printf("Could not create traefik config: %s", err)
+				v.log.Error("Could not create traefik config", "error", err)
+				metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+				tracing.RecordError(span, err)
+			}
+			err = ioutil.WriteFile(traefikConfigFilePath, traefikCfgBytes, 0600)
+			if err != nil {
+				v.log.Error("Could not write traefik config", "path", traefikConfigFilePath, "error", err)
+				metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+				tracing.RecordError(span, err)
 			}
-			ioutil.WriteFile(traefikConfigFilePath, traefikCfgBytes, 0600)
+			aggregator.MarkApplied(v.GetInfo().Name)
+			span.End()
 
 		case <-(*ctx).Done():
 			return errors.New("context cancelled")
@@ -127,24 +134,163 @@ func (v *TraefikExportClient) Start(ctx *context.Context, ch chan aggregator.Cer
 	}
 }
 
+// Plan compares what Start would write with what is on disk.
+func (v *TraefikExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	var steps []clients.PlanStep
+	keyPairs, err := v.listKeyPairs()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	held := util.NewSetFromArray(keyPairs)
+	removed := util.NewSet[string]()
+
+	for _, cd := range changes {
+		for _, elem := range cd.CertDiff.Added {
+			dir := v.keyPairPath(cd.Sender, elem)
+			keyPEM, certPEM := traefikKeyPair(elem)
+			for _, file := range []struct {
+				name string
+				data []byte
+			}{{"key.pem", keyPEM}, {"cert.pem", certPEM}} {
+				name := path.Join(dir, file.name)
+				cur, err := ioutil.ReadFile(name)
+				switch {
+				case os.IsNotExist(err):
+					steps = append(steps, clients.PlanStep{Action: clients.PlanCreate, Target: name, Detail: elem.Cert.Subject.CommonName})
+				case err != nil:
+					return nil, err
+				case !bytes.Equal(cur, file.data):
+					steps = append(steps, clients.PlanStep{Action: clients.PlanUpdate, Target: name, Detail: elem.Cert.Subject.CommonName})
+				}
+			}
+			if !held.Contains(dir) {
+				held.Add(dir)
+				keyPairs = append(keyPairs, dir)
+			}
+		}
+		for _, elem := range cd.CertDiff.Removed {
+			dir := v.keyPairPath(cd.Sender, elem)
+			if _, err := os.Stat(dir); err == nil {
+				steps = append(steps, clients.PlanStep{Action: clients.PlanDelete, Target: dir, Detail: elem.Cert.Subject.CommonName})
+			}
+			removed.Add(dir)
+		}
+	}
+
+	var remaining []string
+	for _, dir := range keyPairs {
+		if !removed.Contains(dir) {
+			remaining = append(remaining, dir)
+		}
+	}
+	// The same order listKeyPairs finds them in after writing
+	sort.Slice(remaining, func(i, j int) bool {
+		if path.Dir(remaining[i]) != path.Dir(remaining[j]) {
+			return path.Dir(remaining[i]) < path.Dir(remaining[j])
+		}
+		return path.Base(remaining[i]) < path.Base(remaining[j])
+	})
+	newCfg, err := yaml.Marshal(v.configFor(remaining))
+	if err != nil {
+		return nil, err
+	}
+	traefikConfigFilePath := path.Join(v.basePath, "traefik.yaml")
+	curCfg, err := ioutil.ReadFile(traefikConfigFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if diff := util.LineDiff(string(curCfg), string(newCfg)); diff != "" {
+		action := clients.PlanUpdate
+		if os.IsNotExist(err) {
+			action = clients.PlanCreate
+		}
+		steps = append(steps, clients.PlanStep{
+			Action: action,
+			Target: traefikConfigFilePath,
+			Detail: fmt.Sprintf("%d certificate(s)", len(remaining)),
+			Diff:   diff,
+		})
+	}
+	return steps, nil
+}
+
+func (v *TraefikExportClient) keyPairPath(sender string, elem aggregator.CertPackage) string {
+	return path.Join(v.basePath, sender, elem.Cert.SerialNumber.String())
+}
+
+// traefikKeyPair returns the key and certificate chain as they are written.
+func traefikKeyPair(elem aggregator.CertPackage) ([]byte, []byte) {
+	keyPEM := elem.KeyPEM()
+	certStrings := make([]string, len(elem.Chain))
+	for i, cert := range elem.Chain {
+		certStrings[i] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return keyPEM, []byte(strings.Join(certStrings, "\n"))
+}
+
+// listKeyPairs finds the directories holding both a key and a certificate,
+// ordered by importer and serial.
+func (v *TraefikExportClient) listKeyPairs() ([]string, error) {
+	importerFileinfo, err := ioutil.ReadDir(v.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyPairs []string
+	for _, importerDir := range importerFileinfo {
+		if !importerDir.IsDir() {
+			continue
+		}
+
+		importerPath := path.Join(v.basePath, importerDir.Name())
+		fileinfo, err := ioutil.ReadDir(importerPath)
+		if err != nil {
+			v.log.Error("Could not list directory to generate config", "path", importerPath, "error", err)
+			continue
+		}
+		for _, file := range fileinfo {
+			if !file.IsDir() {
+				continue
+			}
+			keyPairPath := path.Join(importerPath, file.Name())
+			_, err1 := os.Stat(path.Join(keyPairPath, "key.pem"))
+			_, err2 := os.Stat(path.Join(keyPairPath, "cert.pem"))
+			if err1 != nil || err2 != nil {
+				v.log.Warn("Could not find key or cert file", "path", keyPairPath)
+				continue
+			}
+			keyPairs = append(keyPairs, keyPairPath)
+		}
+	}
+	return keyPairs, nil
+}
+
+func (v *TraefikExportClient) configFor(keyPairs []string) TraefikConfig {
+	var cfg TraefikConfig
+	for _, keyPairPath := range keyPairs {
+		keyPath, _ := filepath.Abs(path.Join(keyPairPath, "key.pem"))
+		certPath, _ := filepath.Abs(path.Join(keyPairPath, "cert.pem"))
+		cfg.Tls.Certificates = append(cfg.Tls.Certificates, TraefikCertificateConfig{
+			KeyFile:  keyPath,
+			CertFile: certPath,
+		})
+	}
+	return cfg
+}
+
 func (v *TraefikExportClient) Configure(cc config.ClientConfiguration) error {
 	v.config = cc
-	v.basePath = path.Clean(v.config.Get("baseLocation", os.TempDir()))
-	emptyCfg := TraefikConfig{}
-	empytCfgBytes, err := yaml.Marshal(emptyCfg)
-	if (err != nil){
-		return err
-	}
-	ioutil.WriteFile(path.Join(v.basePath, "traefik.yaml"), empytCfgBytes, 0600)
+	v.basePath = path.Clean(v.config["baseLocation"])
 	return nil
 }
 
 func (v *TraefikExportClient) GetInfo() config.ClientInfo {
 	return config.ClientInfo{
-		Name: "traefik",
-		ConfigHelp: map[string]string{
-			"baseLocation": "where to store all certs",
-			"baz":          "foo",
+		Name: v.name,
+		Type: "traefik",
+		Schema: []config.ConfigKey{
+			{Key: "baseLocation", Type: config.TypeString, Default: os.TempDir(), Description: "where to store all certs"},
+			config.LeaderOnlyKey(false),
 		},
 	}
 }
@@ -0,0 +1,376 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/tracing"
+
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const vaultManagedByValue = "traefik-cert-aggregator"
+
+type vaultPathData struct {
+	CommonName string
+	Serial     string
+}
+
+type VaultExportClient struct {
+	name         string
+	log          *logging.Logger
+	config       config.ClientConfiguration
+	vault        *api.Client
+	certs        certSet
+	owned        map[string]bool
+	mount        string
+	pathTemplate *template.Template
+	certField    string
+	keyField     string
+	deleteMode   string
+}
+
+func NewVaultExportClient(name string) *VaultExportClient {
+	v := VaultExportClient{
+		name:  name,
+		log:   logging.Client(clients.KindExporter, name),
+		certs: make(certSet),
+		owned: make(map[string]bool),
+	}
+	return &v
+}
+
+func (v *VaultExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
+	err := v.loadOwned(*ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var cd aggregator.CertStoreChange
+		var ok bool
+		select {
+		case cd, ok = <-ch:
+			if !ok {
+				return nil
+			}
+			applyCtx, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
+			v.certs.apply(cd)
+			v.sync(applyCtx)
+			aggregator.MarkApplied(v.GetInfo().Name)
+			span.End()
+		case <-(*ctx).Done():
+			return errors.New("context cancelled")
+		}
+	}
+}
+
+// desiredPaths maps the path of every secret which should exist to its certificate.
+func (v *VaultExportClient) desiredPaths(certs certSet) map[string]aggregator.CertPackage {
+	desired := make(map[string]aggregator.CertPackage)
+	for domain, cp := range certs.byCommonName() {
+		var buf strings.Builder
+		err := v.pathTemplate.Execute(&buf, vaultPathData{
+			CommonName: domain,
+			Serial:     cp.Cert.SerialNumber.String(),
+		})
+		if err != nil {
+			v.log.Error("Could not render vault path", "domain", domain, "serial", cp.Cert.SerialNumber.String(), "error", err)
+			continue
+		}
+		desired[path.Clean(buf.String())] = cp
+	}
+	return desired
+}
+
+func (v *VaultExportClient) sync(ctx context.Context) {
+	desired := v.desiredPaths(v.certs)
+	for secretPath, cp := range desired {
+		err := v.write(ctx, secretPath, cp)
+		if err != nil {
+			v.log.Error("Could not write to vault", "path", secretPath, "domain", cp.Cert.Subject.CommonName, "serial", cp.Cert.SerialNumber.String(), "error", err)
+			metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+			tracing.RecordError(trace.SpanFromContext(ctx), err)
+		}
+	}
+
+	for secretPath := range v.owned {
+		if _, ok := desired[secretPath]; ok {
+			continue
+		}
+		err := v.delete(ctx, secretPath)
+		if err != nil {
+			v.log.Error("Could not delete from vault", "path", secretPath, "error", err)
+			metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+			tracing.RecordError(trace.SpanFromContext(ctx), err)
+			continue
+		}
+		delete(v.owned, secretPath)
+	}
+}
+
+// metadata returns the current version of a secret, and whether it was
+// created by the aggregator. A missing secret has version 0.
+func (v *VaultExportClient) metadata(ctx context.Context, secretPath string) (int64, bool, error) {
+	secret, err := v.vault.Logical().ReadWithContext(ctx, path.Join(v.mount, "metadata", secretPath))
+	if err != nil {
+		return 0, false, err
+	}
+	if secret == nil || secret.Data == nil {
+		return 0, false, nil
+	}
+	var version int64
+	if n, ok := secret.Data["current_version"].(json.Number); ok {
+		version, _ = n.Int64()
+	}
+	custom, _ := secret.Data["custom_metadata"].(map[string]interface{})
+	return version, custom["managed-by"] == vaultManagedByValue, nil
+}
+
+func (v *VaultExportClient) write(ctx context.Context, secretPath string, cp aggregator.CertPackage) error {
+	version, marked, err := v.metadata(ctx, secretPath)
+	if err != nil {
+		return err
+	}
+	// A secret this run wrote but could not mark yet is ours as well
+	if version > 0 && !marked && !v.owned[secretPath] {
+		return errors.New("secret exists and is not managed by the aggregator")
+	}
+
+	same := false
+	if version > 0 {
+		same, err = v.unchanged(ctx, secretPath, cp)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !same {
+		certPEM, keyPEM := cp.ChainPEM(), cp.KeyPEM()
+		_, err = v.vault.Logical().WriteWithContext(ctx, path.Join(v.mount, "data", secretPath), map[string]interface{}{
+			"options": map[string]interface{}{
+				"cas": version,
+			},
+			"data": map[string]interface{}{
+				v.certField: string(certPEM),
+				v.keyField:  string(keyPEM),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		v.owned[secretPath] = true
+		v.log.Info("Wrote to vault", "path", secretPath, "domain", cp.Cert.Subject.CommonName, "serial", cp.Cert.SerialNumber.String())
+	}
+
+	// The marker only follows a successful check-and-set write, so a secret
+	// someone else created in the meantime is never taken over
+	if !same || !marked {
+		_, err = v.vault.Logical().WriteWithContext(ctx, path.Join(v.mount, "metadata", secretPath), map[string]interface{}{
+			"custom_metadata": map[string]interface{}{
+				"managed-by": vaultManagedByValue,
+				"serial":     cp.Cert.SerialNumber.String(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	v.owned[secretPath] = true
+	return nil
+}
+
+// unchanged reports whether a secret already holds the certificate.
+func (v *VaultExportClient) unchanged(ctx context.Context, secretPath string, cp aggregator.CertPackage) (bool, error) {
+	current, err := v.vault.Logical().ReadWithContext(ctx, path.Join(v.mount, "data", secretPath))
+	if err != nil || current == nil {
+		return false, err
+	}
+	data, _ := current.Data["data"].(map[string]interface{})
+	curCert, _ := data[v.certField].(string)
+	curKey, _ := data[v.keyField].(string)
+	return bytes.Equal([]byte(curCert), cp.ChainPEM()) && bytes.Equal([]byte(curKey), cp.KeyPEM()), nil
+}
+
+func (v *VaultExportClient) delete(ctx context.Context, secretPath string) error {
+	_, owned, err := v.metadata(ctx, secretPath)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return nil
+	}
+
+	if v.deleteMode == "destroy" {
+		_, err = v.vault.Logical().DeleteWithContext(ctx, path.Join(v.mount, "metadata", secretPath))
+	} else {
+		_, err = v.vault.Logical().DeleteWithContext(ctx, path.Join(v.mount, "data", secretPath))
+	}
+	if err != nil {
+		return err
+	}
+	v.log.Info("Deleted from vault", "path", secretPath, "deleteMode", v.deleteMode)
+	return nil
+}
+
+// loadOwned finds secrets created by a previous run below the static part of
+// the path template, so they can be cleaned up once no longer needed.
+func (v *VaultExportClient) loadOwned(ctx context.Context) error {
+	prefix := v.config["pathTemplate"]
+	if i := strings.Index(prefix, "{{"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	return v.walkOwned(ctx, prefix[:strings.LastIndex(prefix, "/")+1])
+}
+
+// walkOwned checks the secrets of a directory, descending into its
+// subdirectories, as templates may render to nested paths.
+func (v *VaultExportClient) walkOwned(ctx context.Context, dir string) error {
+	secret, err := v.vault.Logical().ListWithContext(ctx, path.Join(v.mount, "metadata", dir))
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, key := range keys {
+		name, _ := key.(string)
+		if name == "" {
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			if err := v.walkOwned(ctx, dir+name); err != nil {
+				return err
+			}
+			continue
+		}
+		secretPath := path.Join(dir, name)
+		_, owned, err := v.metadata(ctx, secretPath)
+		if err != nil {
+			return err
+		}
+		if owned {
+			v.owned[secretPath] = true
+		}
+	}
+	return nil
+}
+
+// Plan lists the keys Start would set and delete, reading vault without
+// writing to it.
+func (v *VaultExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	err := v.loadOwned(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []clients.PlanStep
+	desired := v.desiredPaths(v.certs.withChanges(changes))
+	for _, secretPath := range sortedKeys(desired) {
+		cp := desired[secretPath]
+		target := path.Join(v.mount, "data", secretPath)
+		version, owned, err := v.metadata(ctx, secretPath)
+		if err != nil {
+			return nil, err
+		}
+		if version > 0 && !owned && !v.owned[secretPath] {
+			steps = append(steps, clients.PlanStep{Action: clients.PlanSkip, Target: target, Detail: "exists and is not managed by the aggregator"})
+			continue
+		}
+		if version > 0 {
+			same, err := v.unchanged(ctx, secretPath, cp)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				continue
+			}
+		}
+		steps = append(steps, clients.PlanStep{
+			Action: clients.PlanSet,
+			Target: target,
+			Detail: fmt.Sprintf("%s, %s (serial %s, version %d)", v.certField, v.keyField, cp.Cert.SerialNumber, version+1),
+		})
+	}
+
+	var stale []string
+	for secretPath := range v.owned {
+		if _, ok := desired[secretPath]; !ok {
+			stale = append(stale, secretPath)
+		}
+	}
+	sort.Strings(stale)
+	for _, secretPath := range stale {
+		steps = append(steps, clients.PlanStep{Action: clients.PlanDelete, Target: path.Join(v.mount, "data", secretPath), Detail: v.deleteMode})
+	}
+	return steps, nil
+}
+
+func (v *VaultExportClient) Configure(cc config.ClientConfiguration) error {
+	v.config = cc
+	v.mount = v.config["mount"]
+	v.certField = v.config["certField"]
+	v.keyField = v.config["keyField"]
+	v.deleteMode = v.config["deleteMode"]
+	if v.deleteMode != "soft" && v.deleteMode != "destroy" {
+		return fmt.Errorf("unknown delete mode \"%s\"", v.deleteMode)
+	}
+
+	tmpl, err := template.New("path").Parse(v.config["pathTemplate"])
+	if err != nil {
+		return err
+	}
+	v.pathTemplate = tmpl
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client, err := api.NewClient(&api.Config{
+		Address:    v.config["addr"],
+		HttpClient: &http.Client{Transport: tr},
+	})
+	if err != nil {
+		return err
+	}
+
+	token, err := v.config.GetErr("token")
+	if err != nil {
+		return err
+	}
+	client.SetToken(token)
+	v.vault = client
+	return nil
+}
+
+func (v *VaultExportClient) GetInfo() config.ClientInfo {
+	return config.ClientInfo{
+		Name: v.name,
+		Type: "vault",
+		Schema: []config.ConfigKey{
+			{Key: "token", Type: config.TypeString, Required: true, Secret: true, Description: "vault token with write access to the kv mount"},
+			{Key: "addr", Type: config.TypeString, Default: "https://localhost:8500", Description: "vault address"},
+			{Key: "mount", Type: config.TypeString, Default: "kv", Description: "kv v2 mount to write to"},
+			{Key: "pathTemplate", Type: config.TypeString, Default: "infrastructure/aggregated-certs/{{.CommonName}}", Description: "path template below the mount, with .CommonName and .Serial"},
+			{Key: "certField", Type: config.TypeString, Default: "cert", Description: "field holding the certificate chain"},
+			{Key: "keyField", Type: config.TypeString, Default: "key", Description: "field holding the private key"},
+			{Key: "deleteMode", Type: config.TypeString, Default: "soft", Description: "soft to delete the latest version, destroy to remove all versions and metadata"},
+			config.LeaderOnlyKey(true),
+		},
+	}
+}
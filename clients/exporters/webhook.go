@@ -0,0 +1,426 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type WebhookCertInfo struct {
+	Domains     []string  `json:"domains"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+type WebhookEvent struct {
+	ID      string            `json:"id"`
+	Time    time.Time         `json:"time"`
+	Sender  string            `json:"sender"`
+	Added   []WebhookCertInfo `json:"added"`
+	Removed []WebhookCertInfo `json:"removed"`
+	Rotated []string          `json:"rotated"`
+}
+
+// A response which will not get better by sending the same request again.
+type permanentError struct {
+	status int
+}
+
+func (e permanentError) Error() string {
+	return fmt.Sprintf("webhook rejected event with status %d", e.status)
+}
+
+type WebhookExportClient struct {
+	name       string
+	log        *logging.Logger
+	config     config.ClientConfiguration
+	http       *http.Client
+	url        string
+	secret     []byte
+	outbox     string
+	maxBackoff time.Duration
+}
+
+func NewWebhookExportClient(name string) *WebhookExportClient {
+	v := WebhookExportClient{
+		name: name,
+		log:  logging.Client(clients.KindExporter, name),
+	}
+	return &v
+}
+
+func (v *WebhookExportClient) Start(ctx *context.Context, ch chan aggregator.CertStoreChange) error {
+	announced, err := v.loadAnnounced()
+	if err != nil {
+		return err
+	}
+	var backoff time.Duration
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	for {
+		select {
+		case cd, ok := <-ch:
+			if !ok {
+				// Whatever is not delivered yet stays in the outbox
+				v.flush(*ctx)
+				return nil
+			}
+			_, span := cd.StartSpan(*ctx, "exporter.apply", attribute.String("client", v.GetInfo().Name))
+			ev := announced.event(cd)
+			if len(ev.Added) == 0 && len(ev.Removed) == 0 {
+				aggregator.MarkApplied(v.GetInfo().Name)
+				span.End()
+				continue
+			}
+			err := v.enqueue(ev)
+			if err == nil {
+				announced.record(ev)
+				if err := v.saveAnnounced(announced); err != nil {
+					v.log.Error("Could not save announced certificates", "error", err)
+					tracing.RecordError(span, err)
+				}
+			}
+			aggregator.MarkApplied(v.GetInfo().Name)
+			if err != nil {
+				v.log.Error("Could not queue webhook event", "sender", cd.Sender, "error", err)
+				metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+				tracing.RecordError(span, err)
+				span.End()
+				continue
+			}
+			span.End()
+			if backoff > 0 {
+				continue
+			}
+		case <-retry.C:
+		case <-(*ctx).Done():
+			return errors.New("context cancelled")
+		}
+
+		err := v.flush(*ctx)
+		if err == nil {
+			backoff = 0
+			continue
+		}
+		if backoff == 0 {
+			backoff = time.Second
+		} else if backoff *= 2; backoff > v.maxBackoff {
+			backoff = v.maxBackoff
+		}
+		v.log.Warn("Could not deliver webhook events, retrying", "retry", backoff, "error", err)
+		metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+		if !retry.Stop() {
+			select {
+			case <-retry.C:
+			default:
+			}
+		}
+		retry.Reset(backoff)
+	}
+}
+
+// webhookAnnounced holds the certificates events were queued for, keyed by
+// sender and serial. A started exporter is sent every certificate again, so
+// changes are diffed against it rather than announced as they come.
+type webhookAnnounced struct {
+	certs map[string]WebhookCertInfo
+	// Senders a change arrived for since the exporter started
+	seen map[string]bool
+}
+
+// event returns the event announcing what a change adds to and removes from
+// the announced certificates. The first change for a sender after a start
+// holds all of its certificates, so announced ones missing from it were
+// removed while the exporter was not running.
+func (a *webhookAnnounced) event(cd aggregator.CertStoreChange) WebhookEvent {
+	var added, removed []WebhookCertInfo
+	present := make(map[string]bool)
+	for _, elem := range cd.CertDiff.Added {
+		key := path.Join(cd.Sender, elem.Cert.SerialNumber.String())
+		present[key] = true
+		if _, ok := a.certs[key]; !ok {
+			added = append(added, webhookCertInfo(elem))
+		}
+	}
+	var gone []string
+	for _, elem := range cd.CertDiff.Removed {
+		if key := path.Join(cd.Sender, elem.Cert.SerialNumber.String()); !present[key] {
+			gone = append(gone, key)
+		}
+	}
+	if !a.seen[cd.Sender] {
+		a.seen[cd.Sender] = true
+		for key := range a.certs {
+			if strings.HasPrefix(key, cd.Sender+"/") && !present[key] {
+				gone = append(gone, key)
+			}
+		}
+	}
+	sort.Strings(gone)
+	for i, key := range gone {
+		info, ok := a.certs[key]
+		if ok && (i == 0 || gone[i-1] != key) {
+			removed = append(removed, info)
+		}
+	}
+	return newWebhookEvent(cd.Sender, added, removed)
+}
+
+// record notes an event as queued.
+func (a *webhookAnnounced) record(ev WebhookEvent) {
+	for _, info := range ev.Removed {
+		delete(a.certs, path.Join(ev.Sender, info.Serial))
+	}
+	for _, info := range ev.Added {
+		a.certs[path.Join(ev.Sender, info.Serial)] = info
+	}
+}
+
+func newWebhookEvent(sender string, added []WebhookCertInfo, removed []WebhookCertInfo) WebhookEvent {
+	now := time.Now()
+	ev := WebhookEvent{
+		ID:      fmt.Sprintf("%s-%d", sender, now.UnixNano()),
+		Time:    now,
+		Sender:  sender,
+		Added:   append([]WebhookCertInfo{}, added...),
+		Removed: append([]WebhookCertInfo{}, removed...),
+		Rotated: []string{},
+	}
+
+	addedDomains := make(map[string]bool)
+	for _, info := range added {
+		for _, domain := range info.Domains {
+			addedDomains[domain] = true
+		}
+	}
+	for _, info := range removed {
+		for _, domain := range info.Domains {
+			if addedDomains[domain] {
+				ev.Rotated = append(ev.Rotated, domain)
+			}
+		}
+	}
+	return ev
+}
+
+func webhookCertInfo(cp aggregator.CertPackage) WebhookCertInfo {
+	return WebhookCertInfo{
+		Domains:     cp.Domains(),
+		Serial:      cp.Cert.SerialNumber.String(),
+		Fingerprint: cp.Fingerprint(),
+		NotAfter:    cp.Cert.NotAfter,
+	}
+}
+
+func (v *WebhookExportClient) enqueue(ev WebhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(v.outbox, 0700)
+	if err != nil {
+		return err
+	}
+	name := path.Join(v.outbox, fmt.Sprintf("%020d.json", ev.Time.UnixNano()))
+	err = ioutil.WriteFile(name+".tmp", body, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (v *WebhookExportClient) announcedFile() string {
+	return path.Join(v.outbox, "announced.state")
+}
+
+// loadAnnounced reads the certificates events were queued for before.
+func (v *WebhookExportClient) loadAnnounced() (*webhookAnnounced, error) {
+	a := &webhookAnnounced{
+		certs: make(map[string]WebhookCertInfo),
+		seen:  make(map[string]bool),
+	}
+	data, err := ioutil.ReadFile(v.announcedFile())
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.certs); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", v.announcedFile(), err)
+	}
+	return a, nil
+}
+
+func (v *WebhookExportClient) saveAnnounced(a *webhookAnnounced) error {
+	data, err := json.Marshal(a.certs)
+	if err != nil {
+		return err
+	}
+	name := v.announcedFile()
+	err = ioutil.WriteFile(name+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// flush delivers queued events oldest first, stopping at the first one
+// which could not be delivered so ordering is kept.
+func (v *WebhookExportClient) flush(ctx context.Context) error {
+	files, err := ioutil.ReadDir(v.outbox)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		eventPath := path.Join(v.outbox, name)
+		body, err := ioutil.ReadFile(eventPath)
+		if err != nil {
+			return err
+		}
+		err = v.post(ctx, body)
+		var perm permanentError
+		if errors.As(err, &perm) {
+			v.log.Error("Dropping webhook event", "event", name, "error", err)
+			metrics.ExportFailures.WithLabelValues(v.GetInfo().Name).Inc()
+		} else if err != nil {
+			return err
+		}
+		err = os.Remove(eventPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *WebhookExportClient) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "traefik-cert-aggregator")
+	if len(v.secret) > 0 {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(body)
+		req.Header.Set("X-Cert-Agg-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{status: resp.StatusCode}
+	}
+	return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+}
+
+// Plan lists the events which would be posted, starting with the ones still
+// waiting in the outbox.
+func (v *WebhookExportClient) Plan(ctx context.Context, changes []aggregator.CertStoreChange) ([]clients.PlanStep, error) {
+	var steps []clients.PlanStep
+	files, err := ioutil.ReadDir(v.outbox)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	queued := 0
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			queued++
+		}
+	}
+	if queued > 0 {
+		steps = append(steps, clients.PlanStep{Action: clients.PlanSend, Target: v.url, Detail: fmt.Sprintf("%d queued event(s) from %s", queued, v.outbox)})
+	}
+
+	announced, err := v.loadAnnounced()
+	if err != nil {
+		return nil, err
+	}
+	for _, cd := range changes {
+		ev := announced.event(cd)
+		if len(ev.Added) == 0 && len(ev.Removed) == 0 {
+			continue
+		}
+		announced.record(ev)
+		detail := fmt.Sprintf("%d added, %d removed from \"%s\"", len(ev.Added), len(ev.Removed), ev.Sender)
+		if len(ev.Rotated) > 0 {
+			detail += ", rotated " + strings.Join(ev.Rotated, " ")
+		}
+		steps = append(steps, clients.PlanStep{Action: clients.PlanSend, Target: v.url, Detail: detail})
+	}
+	return steps, nil
+}
+
+func (v *WebhookExportClient) Configure(cc config.ClientConfiguration) error {
+	v.config = cc
+	v.url = v.config["url"]
+	v.secret = []byte(v.config["secret"])
+	v.outbox = v.config["outbox"]
+
+	timeout, err := v.config.GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	v.http = &http.Client{Timeout: timeout}
+
+	v.maxBackoff, err = v.config.GetDuration("maxBackoff")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v *WebhookExportClient) GetInfo() config.ClientInfo {
+	return config.ClientInfo{
+		Name: v.name,
+		Type: "webhook",
+		Schema: []config.ConfigKey{
+			{Key: "url", Type: config.TypeString, Required: true, Description: "endpoint events are POSTed to"},
+			{Key: "secret", Type: config.TypeString, Secret: true, Description: "key used to sign the body, sent as X-Cert-Agg-Signature"},
+			{Key: "outbox", Type: config.TypeString, Required: true, Description: "directory undelivered events and the certificates already announced are kept in, it has to survive restarts"},
+			{Key: "timeout", Type: config.TypeDuration, Default: "10s", Description: "timeout for a single request"},
+			{Key: "maxBackoff", Type: config.TypeDuration, Default: "5m", Description: "longest wait between delivery attempts"},
+			config.LeaderOnlyKey(true),
+		},
+	}
+}
@@ -0,0 +1,166 @@
+package exporters
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients/config"
+)
+
+// webhookReceiver is a webhook endpoint failing the first requests it gets
+// with the given statuses.
+type webhookReceiver struct {
+	lock     sync.Mutex
+	failWith []int
+	attempts int
+	events   []WebhookEvent
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if req.Header.Get("X-Cert-Agg-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts++
+	if len(r.failWith) > 0 {
+		w.WriteHeader(r.failWith[0])
+		r.failWith = r.failWith[1:]
+		return
+	}
+	var ev WebhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, ev)
+}
+
+func (r *webhookReceiver) received() ([]WebhookEvent, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]WebhookEvent{}, r.events...), r.attempts
+}
+
+func newTestWebhook(t *testing.T, url string, outbox string) *WebhookExportClient {
+	v := NewWebhookExportClient("webhook")
+	cc, err := v.GetInfo().Prepare(config.ClientConfiguration{"url": url, "secret": "s3cret", "outbox": outbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Configure(cc); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// runWebhook runs the exporter on the given changes, as one run of the
+// process, and returns once it delivered what it queued.
+func runWebhook(t *testing.T, url string, outbox string, changes ...aggregator.CertStoreChange) {
+	v := newTestWebhook(t, url, outbox)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ch := make(chan aggregator.CertStoreChange)
+	done := make(chan error)
+	go func() { done <- v.Start(&ctx, ch) }()
+	for _, cd := range changes {
+		ch <- cd
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func added(sender string, cps ...aggregator.CertPackage) aggregator.CertStoreChange {
+	return aggregator.CertStoreChange{Sender: sender, CertDiff: aggregator.CertDiff{Added: cps}}
+}
+
+func TestWebhookRetriesDelivery(t *testing.T) {
+	receiver := &webhookReceiver{failWith: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	outbox := t.TempDir()
+
+	cp := testCertPackage(t, "a.example.com")
+	v := newTestWebhook(t, server.URL, outbox)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ch := make(chan aggregator.CertStoreChange, 1)
+	done := make(chan error)
+	go func() { done <- v.Start(&ctx, ch) }()
+	ch <- added("vault", cp)
+
+	// The first attempt fails, the retry after a second is delivered
+	for {
+		if events, attempts := receiver.received(); len(events) > 0 {
+			if attempts != 2 {
+				t.Errorf("expected 2 attempts, got %d", attempts)
+			}
+			ev := events[0]
+			if ev.Sender != "vault" || len(ev.Added) != 1 || ev.Added[0].Serial != cp.Cert.SerialNumber.String() || ev.Added[0].Fingerprint != cp.Fingerprint() {
+				t.Errorf("unexpected event %+v", ev)
+			}
+			break
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("event was not delivered")
+		}
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "announced.state" {
+			t.Errorf("outbox still holds %s", file.Name())
+		}
+	}
+}
+
+func TestWebhookAnnouncesOnlyChangesAcrossRestarts(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	outbox := t.TempDir()
+	a := testCertPackage(t, "a.example.com")
+	b := testCertPackage(t, "b.example.com")
+
+	runWebhook(t, server.URL, outbox, added("vault", a, b))
+	// A restart is sent everything again
+	runWebhook(t, server.URL, outbox, added("vault", a, b))
+	// b went away while the exporter was not running
+	runWebhook(t, server.URL, outbox, added("vault", a))
+
+	events, _ := receiver.received()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d: %+v", len(events), events)
+	}
+	if len(events[0].Added) != 2 || len(events[0].Removed) != 0 {
+		t.Errorf("first event should add both certificates: %+v", events[0])
+	}
+	if len(events[1].Added) != 0 || len(events[1].Removed) != 1 || events[1].Removed[0].Serial != b.Cert.SerialNumber.String() {
+		t.Errorf("second event should only remove b: %+v", events[1])
+	}
+}
@@ -6,6 +6,7 @@ import (
 )
 
 func AddAllClients(cfg config.Config) {
-	clients.AddImportClient(NewMockClient())
-	clients.AddImportClient(NewVaultClient())
+	clients.AddImportClient("mock", NewMockClient)
+	clients.AddImportClient("vault", NewVaultClient)
+	clients.AddImportClient("kubernetes", NewKubernetesClient)
 }
@@ -0,0 +1,189 @@
+package importers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type KubernetesClient struct {
+	name          string
+	log           *logging.Logger
+	config        config.ClientConfiguration
+	manager       *aggregator.CertManager
+	client        kubernetes.Interface
+	namespaces    []string
+	labelSelector string
+	resync        time.Duration
+	rejects
+}
+
+func NewKubernetesClient(name string) *KubernetesClient {
+	v := KubernetesClient{
+		name: name,
+		log:  logging.Client(clients.KindImporter, name),
+	}
+	v.manager = aggregator.NewCertManager(v.GetInfo().Name)
+	return &v
+}
+
+func (v *KubernetesClient) Start(ctx *context.Context) error {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) { notify() },
+		DeleteFunc: func(obj interface{}) { notify() },
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	var listers []listersv1.SecretLister
+	for _, ns := range v.namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(v.client, v.resync,
+			informers.WithNamespace(ns),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = v.labelSelector
+				opts.FieldSelector = fmt.Sprintf("type=%s", corev1.SecretTypeTLS)
+			}))
+		informer := factory.Core().V1().Secrets()
+		informer.Informer().AddEventHandler(handler)
+		listers = append(listers, informer.Lister())
+		factory.Start(stop)
+		for _, synced := range factory.WaitForCacheSync(stop) {
+			if !synced {
+				return errors.New("could not sync secret informer")
+			}
+		}
+	}
+	v.log.Info("Watching TLS secrets", "namespaces", len(v.namespaces))
+
+	notify()
+	for {
+		select {
+		case <-changed:
+			var secrets []*corev1.Secret
+			for _, lister := range listers {
+				listed, err := lister.List(labels.Everything())
+				if err != nil {
+					return err
+				}
+				secrets = append(secrets, listed...)
+			}
+			syncCtx, span := tracing.Tracer().Start(*ctx, "importer.poll", trace.WithAttributes(attribute.String("client", v.GetInfo().Name)))
+			v.sync(syncCtx, secrets)
+			span.End()
+		case <-(*ctx).Done():
+			return errors.New("context cancelled")
+		}
+	}
+}
+
+// Poll lists the TLS secrets once, without watching them.
+func (v *KubernetesClient) Poll(ctx context.Context) error {
+	ctx, span := tracing.Tracer().Start(ctx, "importer.poll", trace.WithAttributes(attribute.String("client", v.GetInfo().Name)))
+	defer span.End()
+	var secrets []*corev1.Secret
+	for _, ns := range v.namespaces {
+		list, err := v.client.CoreV1().Secrets(ns).List(ctx, metav1.ListOptions{
+			LabelSelector: v.labelSelector,
+			FieldSelector: fmt.Sprintf("type=%s", corev1.SecretTypeTLS),
+		})
+		if err != nil {
+			tracing.RecordError(span, err)
+			return err
+		}
+		for i := range list.Items {
+			secrets = append(secrets, &list.Items[i])
+		}
+	}
+	v.sync(ctx, secrets)
+	return nil
+}
+
+func (v *KubernetesClient) sync(ctx context.Context, secrets []*corev1.Secret) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("secrets", len(secrets)))
+	v.manager.BeginChanges(ctx)
+	defer v.manager.EndChanges()
+	v.reset()
+	for _, secret := range secrets {
+		chain, key, err := parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			v.log.Warn("Could not parse secret", "namespace", secret.Namespace, "name", secret.Name, "error", err)
+			v.add(secret.Namespace+"/"+secret.Name, err)
+			continue
+		}
+		if v.manager.AddCert(chain[0], chain, key) {
+			v.log.Info("New cert", "domain", chain[0].Subject.CommonName, "serial", chain[0].SerialNumber.String(), "namespace", secret.Namespace, "name", secret.Name)
+		}
+	}
+	v.manager.DeleteUntouchedCerts()
+}
+
+func (v *KubernetesClient) Configure(cc config.ClientConfiguration) error {
+	v.config = cc
+	v.labelSelector = v.config["labelSelector"]
+	resync, err := v.config.GetDuration("resync")
+	if err != nil {
+		return err
+	}
+	v.resync = resync
+
+	v.namespaces = v.config.GetList("namespaces")
+	if len(v.namespaces) == 0 {
+		v.namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var restConfig *rest.Config
+	if kubeconfig := v.config["kubeconfig"]; kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	v.client = client
+	return nil
+}
+
+func (v *KubernetesClient) GetInfo() config.ClientInfo {
+	return config.ClientInfo{
+		Name: v.name,
+		Type: "kubernetes",
+		Schema: []config.ConfigKey{
+			{Key: "kubeconfig", Type: config.TypeString, Description: "path to a kubeconfig, in-cluster credentials are used when empty"},
+			{Key: "namespaces", Type: config.TypeList, Description: "namespaces to watch, all namespaces when empty"},
+			{Key: "labelSelector", Type: config.TypeString, Default: "app.kubernetes.io/managed-by!=traefik-cert-aggregator", Description: "label selector secrets have to match"},
+			{Key: "resync", Type: config.TypeDuration, Default: "10m", Description: "interval at which the informer cache is resynced"},
+		},
+	}
+}
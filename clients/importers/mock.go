@@ -5,40 +5,40 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"errors"
-	"log"
 	"math/big"
 	"time"
 	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
 	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type MockClient struct {
+	name    string
+	log     *logging.Logger
 	config  config.ClientConfiguration
 	manager *aggregator.CertManager
+	present bool
 }
 
-func NewMockClient() *MockClient {
-	v := MockClient{}
+func NewMockClient(name string) *MockClient {
+	v := MockClient{
+		name: name,
+		log:  logging.Client(clients.KindImporter, name),
+	}
 	v.manager = aggregator.NewCertManager(v.GetInfo().Name)
 	return &v
 }
 
 func (v *MockClient) Start(ctx *context.Context) error {
-	log.Println("mock started")
-	var b = false
+	v.log.Info("Mock started")
 runLoop:
 	for {
-		b = !b
-		v.manager.BeginChanges()
-		if b {
-			cert := x509.Certificate{SerialNumber: big.NewInt(10567)}
-			fc := []*x509.Certificate{&cert}
-			pk := rsa.PrivateKey{}
-			v.manager.AddCert(&cert, fc, &pk)
-		}
-
-		v.manager.DeleteUntouchedCerts()
-		v.manager.EndChanges()
+		v.Poll(*ctx)
 		select {
 		case <-time.After(time.Second * 4):
 		case <-(*ctx).Done():
@@ -48,6 +48,24 @@ runLoop:
 	return errors.New("context cancelled")
 }
 
+// Poll alternates between holding one certificate and holding none.
+func (v *MockClient) Poll(ctx context.Context) error {
+	ctx, span := tracing.Tracer().Start(ctx, "importer.poll", trace.WithAttributes(attribute.String("client", v.GetInfo().Name)))
+	defer span.End()
+	v.present = !v.present
+	v.manager.BeginChanges(ctx)
+	if v.present {
+		cert := x509.Certificate{SerialNumber: big.NewInt(10567)}
+		fc := []*x509.Certificate{&cert}
+		pk := rsa.PrivateKey{}
+		v.manager.AddCert(&cert, fc, &pk)
+	}
+
+	v.manager.DeleteUntouchedCerts()
+	v.manager.EndChanges()
+	return nil
+}
+
 func (v *MockClient) Configure(cc config.ClientConfiguration) error {
 	v.config = cc
 	return nil
@@ -55,10 +73,7 @@ func (v *MockClient) Configure(cc config.ClientConfiguration) error {
 
 func (v *MockClient) GetInfo() config.ClientInfo {
 	return config.ClientInfo{
-		Name: "mock",
-		ConfigHelp: map[string]string{
-			"foobar": "myhelp",
-			"baz":    "foo",
-		},
+		Name: v.name,
+		Type: "mock",
 	}
 }
@@ -0,0 +1,75 @@
+package importers
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+)
+
+// rejects keeps the secrets the last poll could not use, for inspect.
+type rejects struct {
+	lock sync.Mutex
+	list []clients.Rejected
+}
+
+func (r *rejects) reset() {
+	r.lock.Lock()
+	r.list = nil
+	r.lock.Unlock()
+}
+
+func (r *rejects) add(source string, err error) {
+	r.lock.Lock()
+	r.list = append(r.list, clients.Rejected{Source: source, Error: err.Error()})
+	r.lock.Unlock()
+}
+
+func (r *rejects) Rejected() []clients.Rejected {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := append([]clients.Rejected{}, r.list...)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Source < ret[j].Source })
+	return ret
+}
+
+// parseKeyPair parses a PEM encoded chain and the private key of its first
+// certificate. Keys of unsupported types, and keys not belonging to the
+// certificate, are errors naming why, for the importer to log per secret.
+func parseKeyPair(chainPEM []byte, keyPEM []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	var chain []*x509.Certificate
+	der, rest := pem.Decode(chainPEM)
+	for der != nil {
+		cert, err := x509.ParseCertificate(der.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, cert)
+		der, rest = pem.Decode(rest)
+	}
+	if len(chain) == 0 {
+		return nil, nil, errors.New("no certificate found")
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("no private key found")
+	}
+	key, err := aggregator.ParsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse %s: %s", block.Type, err)
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if !pub.Equal(chain[0].PublicKey) {
+		return nil, nil, fmt.Errorf("private key does not match the certificate for %s", chain[0].Subject.CommonName)
+	}
+	return chain, key, nil
+}
@@ -2,34 +2,46 @@ package importers
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
 	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/tracing"
 
 	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type VaultClient struct {
+	name    string
+	log     *logging.Logger
 	config  config.ClientConfiguration
 	manager *aggregator.CertManager
 	vault   *api.Client
+	rejects
 }
 
 type TLSEntry struct {
-	PrivateKey *rsa.PrivateKey
+	PrivateKey crypto.Signer
 	Chain []*x509.Certificate
 }
 
-func NewVaultClient() *VaultClient {
-	v := VaultClient{}
+func NewVaultClient(name string) *VaultClient {
+	v := VaultClient{
+		name: name,
+		log:  logging.Client(clients.KindImporter, name),
+	}
 	v.manager = aggregator.NewCertManager(v.GetInfo().Name)
 	return &v
 }
@@ -39,64 +51,129 @@ func NewVaultClient() *VaultClient {
 func (v *VaultClient) Start(ctx *context.Context) error {
 runLoop:
 	for {
-		v.manager.BeginChanges()
-		secret, err := v.vault.Logical().ListWithContext(*ctx, "kv/metadata/infrastructure/le-certs")
+		err := v.Poll(*ctx)
 		if err != nil {
 			return err
 		}
-		allVaultKeys, ok := secret.Data["keys"]
-		if !ok {
-			return errors.New("could not list keys")
+		select {
+		case <-time.After(time.Second * 10):
+		case <-(*ctx).Done():
+			break runLoop
 		}
+	}
+	return errors.New("context cancelled")
+}
+
+func (v *VaultClient) Poll(ctx context.Context) error {
+	ctx, span := tracing.Tracer().Start(ctx, "importer.poll", trace.WithAttributes(attribute.String("client", v.GetInfo().Name)))
+	defer span.End()
+	err := v.poll(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+	}
+	return err
+}
 
-		var wg sync.WaitGroup
-		domainData := allVaultKeys.([]interface{}) 
-		parsedChan := make(chan TLSEntry, len(domainData)+1)
-		
-		for _, vaultKeyBasename := range domainData {
-			wg.Add(1)
-			go func (vaultKey string) {
-				certSecret, err := v.vault.Logical().ReadWithContext(*ctx, "kv/data/infrastructure/le-certs/"+vaultKey)
+func (v *VaultClient) poll(ctx context.Context) error {
+	v.manager.BeginChanges(ctx)
+	v.reset()
+	completed := false
+	defer func() {
+		if !completed {
+			v.manager.AbortChanges()
+		}
+	}()
+
+	secret, err := v.traced(ctx, "vault.list", "kv/metadata/infrastructure/le-certs", v.vault.Logical().ListWithContext)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("no certificates found")
+	}
+	domainData, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return errors.New("could not list keys")
+	}
+
+	var wg sync.WaitGroup
+	parsedChan := make(chan TLSEntry, len(domainData)+1)
+	// A certificate which could not be read is not absent, so a single
+	// failed read, or a panic while parsing it, fails the whole poll and the
+	// previous set is kept.
+	var readLock sync.Mutex
+	var readErrs []string
+
+	for _, vaultKeyBasename := range domainData {
+		vaultKey, ok := vaultKeyBasename.(string)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(vaultKey string) {
+			defer wg.Done()
+			var err error
+			defer func() {
 				if err != nil {
-					return
+					readLock.Lock()
+					readErrs = append(readErrs, fmt.Sprintf("%s: %s", vaultKey, err))
+					readLock.Unlock()
 				}
+			}()
+			defer clients.Recover(&err)
+			certSecret, err := v.traced(ctx, "vault.read", "kv/data/infrastructure/le-certs/"+vaultKey, v.vault.Logical().ReadWithContext)
+			if err == nil && certSecret == nil {
+				err = errors.New("not found")
+			}
+			if err != nil {
+				return
+			}
 
-				rawKVData, ok := certSecret.Data["data"]
-				if !ok || rawKVData == nil {
-					return
-				}
-				kvDataInterfaceMap := rawKVData.(map[string]interface{})
-	
-				foundKey, okm := kvDataInterfaceMap["key"].(string)
-				foundCertChain, okk := kvDataInterfaceMap["cert"].(string)
-				if !okm || !okk {
-					log.Printf("unable to get data for %s", vaultKey)
-					return
-				}
+			kvDataInterfaceMap, ok := certSecret.Data["data"].(map[string]interface{})
+			if !ok {
+				return
+			}
 
-				asyncParse(parsedChan, vaultKey, foundKey, foundCertChain)
-				wg.Done()
-			} (vaultKeyBasename.(string))
-		}
-		
-		wg.Wait()
-		close(parsedChan)
-		for entry := range parsedChan {
-			added := v.manager.AddCert(entry.Chain[0], entry.Chain, entry.PrivateKey)
-			if added {
-				log.Printf("vault: New cert for %s", entry.Chain[0].Subject.CommonName)
+			foundKey, okm := kvDataInterfaceMap["key"].(string)
+			foundCertChain, okk := kvDataInterfaceMap["cert"].(string)
+			if !okm || !okk {
+				v.log.Warn("Unable to get data", "domain", vaultKey)
+				v.add(vaultKey, errors.New("no cert and key fields"))
+				return
 			}
-		}
 
-		v.manager.DeleteUntouchedCerts()
-		v.manager.EndChanges()
-		select {
-		case <-time.After(time.Second * 10):
-		case <-(*ctx).Done():
-			break runLoop
+			v.asyncParse(parsedChan, vaultKey, foundKey, foundCertChain)
+		}(vaultKey)
+	}
+
+	wg.Wait()
+	close(parsedChan)
+	if len(readErrs) > 0 {
+		sort.Strings(readErrs)
+		return fmt.Errorf("could not import %d of %d certificates: %s", len(readErrs), len(domainData), strings.Join(readErrs, "; "))
+	}
+	for entry := range parsedChan {
+		added := v.manager.AddCert(entry.Chain[0], entry.Chain, entry.PrivateKey)
+		if added {
+			v.log.Info("New cert", "domain", entry.Chain[0].Subject.CommonName, "serial", entry.Chain[0].SerialNumber.String())
 		}
 	}
-	return errors.New("context cancelled")
+
+	v.manager.DeleteUntouchedCerts()
+	v.manager.EndChanges()
+	completed = true
+	return nil
+}
+
+// traced runs a single request against Vault in a span of its own.
+func (v *VaultClient) traced(ctx context.Context, name string, vaultPath string, request func(context.Context, string) (*api.Secret, error)) (*api.Secret, error) {
+	ctx, span := tracing.Tracer().Start(ctx, name, trace.WithAttributes(attribute.String("vault.path", vaultPath)))
+	defer span.End()
+	secret, err := request(ctx, vaultPath)
+	if err != nil {
+		tracing.RecordError(span, err)
+	}
+	return secret, err
 }
 
 func (v *VaultClient) Configure(cc config.ClientConfiguration) error {
@@ -108,7 +185,7 @@ func (v *VaultClient) Configure(cc config.ClientConfiguration) error {
 	httpClient := &http.Client{Transport: tr}
 
 	client, err := api.NewClient(&api.Config{
-		Address:    v.config.Get("addr", "https://localhost:8500"),
+		Address:    v.config["addr"],
 		HttpClient: httpClient,
 	})
 
@@ -125,30 +202,20 @@ func (v *VaultClient) Configure(cc config.ClientConfiguration) error {
 
 func (v *VaultClient) GetInfo() config.ClientInfo {
 	return config.ClientInfo{
-		Name: "vault",
-		ConfigHelp: map[string]string{
-			"token": "",
-			"baz":   "foo",
+		Name: v.name,
+		Type: "vault",
+		Schema: []config.ConfigKey{
+			{Key: "token", Type: config.TypeString, Required: true, Secret: true, Description: "vault token with read access to the certificates"},
+			{Key: "addr", Type: config.TypeString, Default: "https://localhost:8500", Description: "vault address"},
 		},
 	}
 }
 
-func asyncParse(results chan TLSEntry, domain string, key string, chain string ) {
-	var der, rest = pem.Decode([]byte(chain))
-	var fullChain []*x509.Certificate
-	for der != nil {
-		singleCert, err := x509.ParseCertificate(der.Bytes)
-		if err != nil {
-			return
-		}
-		fullChain = append(fullChain, singleCert)
-		der, rest = pem.Decode(rest)
-	}
-
-	pemBlock, _ := pem.Decode([]byte(key))
-	parsedKey, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+func (v *VaultClient) asyncParse(results chan TLSEntry, domain string, key string, chain string) {
+	fullChain, parsedKey, err := parseKeyPair([]byte(chain), []byte(key))
 	if err != nil {
-		log.Printf("Could not parse private key for %s, because %s", domain, err)
+		v.log.Warn("Could not parse secret", "domain", domain, "error", err)
+		v.add(domain, err)
 		return
 	}
 	te := TLSEntry{PrivateKey: parsedKey, Chain: fullChain}
@@ -0,0 +1,38 @@
+package clients
+
+import (
+	"context"
+	"strings"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/config"
+)
+
+// Inspect polls a single importer once and returns everything it found,
+// along with the secrets it could not use. The importer does not have to
+// be enabled, only configured.
+func Inspect(ctx context.Context, cfg *config.Config, name string) ([]aggregator.CertPackage, []Rejected, error) {
+	name = strings.ToLower(name)
+	c, err := instance(KindImporter, name, cfg.ImporterConfig.Get(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	client := c.(ImportClient)
+
+	cc, err := client.GetInfo().Prepare(cfg.ImporterConfig.Get(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	err = configureClient(KindImporter, client, cc, aggregator.SetImportFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = protect(func() error { return client.Poll(ctx) })
+	if err != nil {
+		return nil, nil, err
+	}
+	var rejected []Rejected
+	if r, ok := client.(RejectReporter); ok {
+		rejected = r.Rejected()
+	}
+	return aggregator.ImportedCerts(name), rejected, nil
+}
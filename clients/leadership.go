@@ -0,0 +1,94 @@
+package clients
+
+import (
+	"context"
+	"sync"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/metrics"
+)
+
+// leadership tracks whether this instance may run leader only exporters.
+type leadership struct {
+	lock    sync.Mutex
+	enabled bool
+	leader  bool
+	// Closed and replaced whenever leadership changes
+	changed chan struct{}
+}
+
+var lead = &leadership{changed: make(chan struct{})}
+
+func (l *leadership) enable() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.enabled = true
+}
+
+func (l *leadership) set(leader bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.leader = leader
+	close(l.changed)
+	l.changed = make(chan struct{})
+	if leader {
+		metrics.Leader.Set(1)
+	} else {
+		metrics.Leader.Set(0)
+	}
+}
+
+func (l *leadership) get() (bool, bool, <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.enabled, l.leader, l.changed
+}
+
+// Leader reports whether leader election is enabled, and if so whether this
+// instance is the leader.
+func Leader() (bool, bool) {
+	enabled, leader, _ := lead.get()
+	return enabled, leader
+}
+
+// runLeaderOnly runs an exporter while this instance is the leader, and
+// stops it whenever leadership is lost.
+func runLeaderOnly(ctx context.Context, name string, start func(context.Context)) {
+	for {
+		_, leader, changed := lead.get()
+		if !leader {
+			updateStatus(KindExporter, name, func(st *ClientStatus) {
+				st.State = StateStandby
+			})
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		leadCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			for {
+				_, leader, changed := lead.get()
+				if !leader {
+					cancel()
+					return
+				}
+				select {
+				case <-changed:
+				case <-leadCtx.Done():
+					return
+				}
+			}
+		}()
+		start(leadCtx)
+		// Stopped by itself, when shutting down or given up on
+		stopped := leadCtx.Err() == nil
+		cancel()
+		if stopped || ctx.Err() != nil {
+			return
+		}
+		aggregator.RemoveOutput(name)
+	}
+}
@@ -0,0 +1,266 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/leader"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+)
+
+// oneShot is a single round of polling, with the aggregator running until
+// it is stopped.
+type oneShot struct {
+	importers      []ImportClient
+	exporters      []ExportClient
+	stopAggregator context.CancelFunc
+	aggregatorDone chan struct{}
+}
+
+// startOneShot configures the clients and starts the aggregator.
+func startOneShot(cfg *config.Config) (*oneShot, error) {
+	importers := configureClients[ImportClient](KindImporter, &cfg.ImporterConfig, cfg.EnabledImporters, aggregator.SetImportFilter)
+	exporters := configureClients[ExportClient](KindExporter, &cfg.ExporterConfig, cfg.EnabledExporters, aggregator.SetExportFilter)
+	if len(exporters) == 0 || len(importers) == 0 {
+		logging.Error("Not enough clients configured", "importers", len(importers), "exporters", len(exporters))
+		return nil, errors.New("no client configured for running")
+	}
+	checkRoutes(cfg.Routes, importers, exporters)
+	aggregator.SetRoutes(cfg.Routes)
+
+	aggCtx, stopAggregator := context.WithCancel(context.Background())
+	o := &oneShot{
+		importers:      importers,
+		exporters:      exporters,
+		stopAggregator: stopAggregator,
+		aggregatorDone: make(chan struct{}),
+	}
+	go func() {
+		defer close(o.aggregatorDone)
+		aggregator.StartAggregating(aggCtx)
+	}()
+	return o, nil
+}
+
+// poll runs every importer once. Nothing may be exported if any of them
+// failed, so a partial poll can't remove certificates from the exporters.
+func (o *oneShot) poll(ctx context.Context) error {
+	var errs []error
+	var errLock sync.Mutex
+	wg := sync.WaitGroup{}
+	for _, c := range o.importers {
+		wg.Add(1)
+		go func(c ImportClient) {
+			defer wg.Done()
+			name := c.GetInfo().Name
+			err := protect(func() error { return c.Poll(ctx) })
+			if err != nil {
+				metrics.PollErrors.WithLabelValues(name).Inc()
+				errLock.Lock()
+				errs = append(errs, fmt.Errorf("importer \"%s\": %s", name, err))
+				errLock.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logging.Error("Poll failed", "error", err)
+		}
+		return fmt.Errorf("%d importer(s) failed, nothing was exported", len(errs))
+	}
+	return nil
+}
+
+// stop waits for everything polled to be handed to the exporters, then
+// stops the aggregator, which closes the exporter channels.
+func (o *oneShot) stop(ctx context.Context) error {
+	err := aggregator.Flush(ctx)
+	o.stopAggregator()
+	<-o.aggregatorDone
+	return err
+}
+
+// campaignOnce tries to take leadership for a single run, giving up after
+// one TTL. It reports whether leader-only exporters may run, and returns a
+// function giving leadership up again.
+func campaignOnce(ctx context.Context, cfg config.LeaderConfig) (bool, func(), error) {
+	elector, err := leader.FromConfig(cfg)
+	if err != nil {
+		return false, nil, err
+	}
+	if elector == nil {
+		return true, func() {}, nil
+	}
+
+	// The lock is renewed for as long as the context given to Campaign
+	// lasts, so only a campaign still waiting is cut short
+	campaignCtx, stopCampaign := context.WithCancel(ctx)
+	timer := time.AfterFunc(cfg.TTL, stopCampaign)
+	resign := func() {
+		stopCampaign()
+		resignCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := elector.Resign(resignCtx); err != nil {
+			logging.Error("Could not resign leadership", "backend", elector.Name(), "error", err)
+		}
+	}
+	_, err = elector.Campaign(campaignCtx)
+	if err == nil && timer.Stop() {
+		logging.Info("Acquired leadership", "backend", elector.Name())
+		return true, resign, nil
+	}
+	stopCampaign()
+	switch {
+	case err == nil:
+		resign()
+		logging.Warn("Took leadership too late, skipping leader-only exporters", "backend", elector.Name())
+	case ctx.Err() == nil && campaignCtx.Err() != nil:
+		logging.Warn("Another instance leads, skipping leader-only exporters", "backend", elector.Name())
+	default:
+		logging.Warn("Could not take leadership, skipping leader-only exporters", "backend", elector.Name(), "error", err)
+	}
+	return false, func() {}, nil
+}
+
+// RunOnce polls every enabled importer once and applies the result to the
+// enabled exporters. With leader election enabled, leader-only exporters
+// are skipped unless leadership could be taken.
+func RunOnce(ctx context.Context, cfg *config.Config) error {
+	o, err := startOneShot(cfg)
+	if err != nil {
+		return err
+	}
+	defer o.stopAggregator()
+	err = o.poll(ctx)
+	if err != nil {
+		return err
+	}
+	leading, resign, err := campaignOnce(ctx, cfg.LeaderElection)
+	if err != nil {
+		return err
+	}
+	defer resign()
+
+	exportCtx, cancelExport := context.WithCancel(ctx)
+	defer cancelExport()
+	var errs []error
+	var errLock sync.Mutex
+	wg := sync.WaitGroup{}
+	failedBefore := make(map[string]float64)
+	for _, c := range o.exporters {
+		name := c.GetInfo().Name
+		cc, _ := c.GetInfo().Prepare(cfg.ExporterConfig.Get(name))
+		if leaderOnly, _ := cc.GetBool("leaderOnly"); leaderOnly && !leading {
+			logging.Info("Skipping leader-only exporter", "exporter", name)
+			continue
+		}
+		failedBefore[name] = metrics.ExportFailureCount(name)
+		ch := aggregator.NewOutputChan(name)
+		wg.Add(1)
+		go func(c ExportClient) {
+			defer wg.Done()
+			err := protect(func() error { return c.Start(&exportCtx, ch) })
+			if err != nil {
+				aggregator.RemoveOutput(name)
+				errLock.Lock()
+				errs = append(errs, fmt.Errorf("exporter \"%s\": %s", name, err))
+				errLock.Unlock()
+			}
+		}(c)
+	}
+
+	err = o.stop(ctx)
+	wg.Wait()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, c := range o.exporters {
+		name := c.GetInfo().Name
+		before, ok := failedBefore[name]
+		if !ok {
+			continue
+		}
+		if failed := metrics.ExportFailureCount(name) - before; failed > 0 {
+			errs = append(errs, fmt.Errorf("exporter \"%s\": %.0f failed write(s)", name, failed))
+		}
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logging.Error("Export failed", "error", err)
+		}
+		return fmt.Errorf("exporting failed with %d error(s)", len(errs))
+	}
+	return nil
+}
+
+// DryRun polls every enabled importer once and returns what each enabled
+// exporter would do with the result, without starting any exporter.
+func DryRun(ctx context.Context, cfg *config.Config) ([]Plan, error) {
+	o, err := startOneShot(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer o.stopAggregator()
+	err = o.poll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	received := make([][]aggregator.CertStoreChange, len(o.exporters))
+	wg := sync.WaitGroup{}
+	for i, c := range o.exporters {
+		name := c.GetInfo().Name
+		ch := aggregator.NewOutputChan(name)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for cd := range ch {
+				received[i] = append(received[i], cd)
+				aggregator.MarkApplied(name)
+			}
+		}(i)
+	}
+	err = o.stop(ctx)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []Plan
+	for i, c := range o.exporters {
+		plan := Plan{Exporter: c.GetInfo().Name, Changes: []PlanChange{}}
+		for _, cd := range received[i] {
+			change := PlanChange{Sender: cd.Sender, Added: []string{}, Removed: []string{}}
+			for _, cp := range cd.CertDiff.Added {
+				change.Added = append(change.Added, planCertName(cp))
+			}
+			for _, cp := range cd.CertDiff.Removed {
+				change.Removed = append(change.Removed, planCertName(cp))
+			}
+			plan.Changes = append(plan.Changes, change)
+		}
+		err := protect(func() error {
+			var err error
+			plan.Steps, err = c.Plan(ctx, received[i])
+			return err
+		})
+		if err != nil {
+			plan.Error = err.Error()
+		}
+		if plan.Steps == nil {
+			plan.Steps = []PlanStep{}
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+func planCertName(cp aggregator.CertPackage) string {
+	return fmt.Sprintf("%s (%s)", cp.Cert.Subject.CommonName, cp.Cert.SerialNumber)
+}
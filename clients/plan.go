@@ -0,0 +1,35 @@
+package clients
+
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+	PlanSet    = "set"
+	PlanRun    = "run"
+	PlanSend   = "send"
+	PlanPrint  = "print"
+	PlanSkip   = "skip"
+)
+
+// PlanStep is one thing an exporter would do to its target.
+type PlanStep struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// PlanChange summarizes a change the aggregator would send an exporter.
+type PlanChange struct {
+	Sender  string   `json:"sender"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// Plan is what a dry run found an exporter would do.
+type Plan struct {
+	Exporter string       `json:"exporter"`
+	Changes  []PlanChange `json:"changes"`
+	Steps    []PlanStep   `json:"steps"`
+	Error    string       `json:"error,omitempty"`
+}
@@ -0,0 +1,184 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"traefik-cert-aggregator/aggregator"
+	clientConfig "traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/filter"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/util"
+)
+
+type runningClient struct {
+	client Client
+	config clientConfig.ClientConfiguration
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Clients currently running, keyed by kind and name.
+var running = make(map[string]*runningClient)
+var runningLock sync.Mutex
+var clientsWg sync.WaitGroup
+var shuttingDown bool
+
+var importCtx, clientExportCtx context.Context
+var sup *supervisor
+
+// startClient runs a configured client with the settings it was configured
+// with. runningLock must be held.
+func startClient(kind string, c Client, cc clientConfig.ClientConfiguration) {
+	parent := importCtx
+	if kind == KindExporter {
+		parent = clientExportCtx
+	}
+	ctx, cancel := context.WithCancel(parent)
+	rc := &runningClient{
+		client: c,
+		config: cc,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	running[kind+"/"+c.GetInfo().Name] = rc
+
+	critical, _ := cc.GetBool("critical")
+	leaderOnly, _ := cc.GetBool("leaderOnly")
+	clientsWg.Add(1)
+	go func() {
+		defer clientsWg.Done()
+		defer close(rc.done)
+		switch kind {
+		case KindImporter:
+			runImportClient(&ctx, c.(ImportClient), critical)
+		case KindExporter:
+			runExportClient(&ctx, c.(ExportClient), critical, leaderOnly)
+		}
+	}()
+}
+
+// stopClient stops a running client and waits for it. runningLock must be held.
+func stopClient(kind string, name string) {
+	rc, ok := running[kind+"/"+name]
+	if !ok {
+		return
+	}
+	rc.cancel()
+	<-rc.done
+	delete(running, kind+"/"+name)
+}
+
+// Reload brings the running clients in line with a new configuration.
+// Clients which were enabled are started, disabled ones stopped, and ones
+// whose configuration changed are replaced by a newly configured instance;
+// when that can't be configured the running one is kept.
+// The aggregated state is kept throughout.
+func Reload(cfg *config.Config) error {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	if sup == nil || shuttingDown {
+		return errors.New("clients are not running")
+	}
+
+	reloadKind(KindImporter, cfg.EnabledImporters, &cfg.ImporterConfig, aggregator.SetImportFilter)
+	reloadKind(KindExporter, cfg.EnabledExporters, &cfg.ExporterConfig, aggregator.SetExportFilter)
+
+	var importers []ImportClient
+	var exporters []ExportClient
+	for _, rc := range running {
+		switch c := rc.client.(type) {
+		case ImportClient:
+			importers = append(importers, c)
+		case ExportClient:
+			exporters = append(exporters, c)
+		}
+	}
+	checkRoutes(cfg.Routes, importers, exporters)
+	aggregator.SetRoutes(cfg.Routes)
+	return nil
+}
+
+func reloadKind(kind string, enabled []string, cfg *config.KeyedKVMap, setFilter func(string, *filter.Rules)) {
+	names := enabledNames(enabled)
+	wanted := util.NewSetFromArray(names)
+
+	var disabled []string
+	for key := range running {
+		if k, name, _ := strings.Cut(key, "/"); k == kind && !wanted.Contains(name) {
+			disabled = append(disabled, name)
+		}
+	}
+	sort.Strings(disabled)
+	for _, name := range disabled {
+		logging.Info("Stopping client, it is no longer enabled", "client", name, "kind", kind)
+		stopClient(kind, name)
+		setFilter(name, nil)
+		logging.SetClientLevel(kind, name, "")
+		removeStatus(kind, name)
+		if kind == KindImporter {
+			aggregator.RemoveSender(name)
+		} else {
+			aggregator.RemoveOutput(name)
+		}
+	}
+
+	for _, name := range names {
+		rc, isRunning := running[kind+"/"+name]
+		var client Client
+		var err error
+		if isRunning {
+			// A running client keeps running until its replacement is configured
+			client, err = newInstance(kind, name, cfg.Get(name))
+		} else {
+			client, err = instance(kind, name, cfg.Get(name))
+		}
+		var cc clientConfig.ClientConfiguration
+		if err == nil {
+			cc, err = client.GetInfo().Prepare(cfg.Get(name))
+		}
+		if err != nil {
+			if isRunning {
+				logging.Error("Invalid configuration, keeping the current one", "client", name, "kind", kind, "error", err)
+			} else {
+				logging.Error("Invalid configuration, not starting client", "client", name, "kind", kind, "error", err)
+			}
+			continue
+		}
+
+		switch {
+		case isRunning && rc.client.GetInfo().Type == client.GetInfo().Type && reflect.DeepEqual(rc.config, cc):
+			continue
+		case isRunning:
+			logging.Info("Reconfiguring client", "client", name, "kind", kind)
+		default:
+			logging.Info("Starting client, it was enabled", "client", name, "kind", kind)
+		}
+
+		err = configureClient(kind, client, cc, setFilter)
+		if err != nil && isRunning {
+			logging.Error("Error while configuring client, keeping the current one", "client", name, "kind", kind, "error", err)
+			updateStatus(kind, name, func(s *ClientStatus) {
+				s.LastError = err.Error()
+			})
+			continue
+		}
+		if err != nil {
+			logging.Error("Error while configuring client, it is not running", "client", name, "kind", kind, "error", err)
+			updateStatus(kind, name, func(s *ClientStatus) {
+				s.State = StateFailed
+				s.LastError = err.Error()
+			})
+			continue
+		}
+		if isRunning {
+			stopClient(kind, name)
+			setInstance(kind, name, client)
+		}
+		startClient(kind, client, cc)
+	}
+}
@@ -0,0 +1,89 @@
+package clients
+
+import (
+	"sort"
+	"sync"
+	"traefik-cert-aggregator/aggregator"
+)
+
+const (
+	KindImporter = "importer"
+	KindExporter = "exporter"
+
+	StateStarting   = "starting"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateStopped    = "stopped"
+	StateFailed     = "failed"
+	StateStandby    = "standby"
+)
+
+// ClientStatus is what /healthz reports about a client. LastError may name
+// hosts, paths or secrets, and is only shown there with the admin token.
+type ClientStatus struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	State     string `json:"state"`
+	LastError string `json:"lastError,omitempty"`
+	Restarts  int    `json:"restarts"`
+	Ready     bool   `json:"ready"`
+
+	ConsecutiveFailures int  `json:"consecutiveFailures"`
+	Critical            bool `json:"critical"`
+}
+
+var statuses = make(map[string]*ClientStatus)
+var statusLock sync.Mutex
+
+func updateStatus(kind string, name string, update func(*ClientStatus)) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	key := kind + "/" + name
+	status, ok := statuses[key]
+	if !ok {
+		status = &ClientStatus{Name: name, Kind: kind, State: StateStarting}
+		statuses[key] = status
+	}
+	update(status)
+}
+
+func removeStatus(kind string, name string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	delete(statuses, kind+"/"+name)
+}
+
+// Statuses reports every configured client. Importers are ready once they
+// completed a poll, exporters once they applied every change sent to them.
+func Statuses() []ClientStatus {
+	statusLock.Lock()
+	var ret []ClientStatus
+	for _, status := range statuses {
+		ret = append(ret, *status)
+	}
+	statusLock.Unlock()
+
+	for i, status := range ret {
+		if status.State == StateStandby {
+			// Waiting for leadership is what a leader only exporter should do
+			ret[i].Ready = true
+			continue
+		}
+		if status.State != StateRunning {
+			continue
+		}
+		switch status.Kind {
+		case KindImporter:
+			ret[i].Ready = !aggregator.LastSync(status.Name).IsZero()
+		case KindExporter:
+			ret[i].Ready = aggregator.OutputApplied(status.Name)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Kind != ret[j].Kind {
+			return ret[i].Kind > ret[j].Kind
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
@@ -0,0 +1,141 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/logging"
+)
+
+// A client which ran at least this long before failing starts over with the
+// initial backoff.
+const stableRunTime = time.Minute
+
+// supervisor restarts failed clients with exponential backoff, and reports
+// critical clients which are given up on.
+type supervisor struct {
+	cfg config.SupervisorConfig
+	// Closed once shutting down, after which nothing is restarted.
+	stopping <-chan struct{}
+
+	errLock sync.Mutex
+	err     error
+}
+
+var failures = make(chan error, 1)
+
+// Failures delivers the first critical client which was given up on.
+func Failures() <-chan error {
+	return failures
+}
+
+// run keeps a client running until ctx is done, the client stops without an
+// error or it is given up on.
+func (s *supervisor) run(ctx context.Context, kind string, name string, critical bool, start func() error) {
+	updateStatus(kind, name, func(st *ClientStatus) {
+		st.Critical = critical
+	})
+	logger := logging.Client(kind, name)
+	consecutive := 0
+	for {
+		logger.Info("Client started")
+		updateStatus(kind, name, func(st *ClientStatus) {
+			st.State = StateRunning
+		})
+		started := time.Now()
+		err := protect(start)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+
+		if time.Since(started) >= stableRunTime {
+			consecutive = 0
+		}
+		consecutive++
+		updateStatus(kind, name, func(st *ClientStatus) {
+			st.State = StateRestarting
+			st.LastError = err.Error()
+			st.Restarts++
+			st.ConsecutiveFailures = consecutive
+		})
+
+		if s.cfg.MaxFailures > 0 && consecutive >= s.cfg.MaxFailures {
+			logger.Error("Client failed too often, giving up", "failures", consecutive, "error", err)
+			updateStatus(kind, name, func(st *ClientStatus) {
+				st.State = StateFailed
+			})
+			if critical {
+				s.fail(fmt.Errorf("critical %s \"%s\" failed: %s", kind, name, err))
+			}
+			return
+		}
+
+		wait := s.backoff(consecutive)
+		logger.Warn("Client terminated, restarting", "retry", wait.Round(time.Millisecond), "failures", consecutive, "error", err)
+		select {
+		case <-time.After(wait):
+			continue
+		case <-ctx.Done():
+		case <-s.stopping:
+		}
+		break
+	}
+	updateStatus(kind, name, func(st *ClientStatus) {
+		st.State = StateStopped
+	})
+}
+
+// backoff doubles with every failure, and is randomized so clients failing
+// together do not retry together.
+func (s *supervisor) backoff(failures int) time.Duration {
+	wait := s.cfg.InitialBackoff
+	for i := 1; i < failures && wait < s.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if s.cfg.MaxBackoff > 0 && wait > s.cfg.MaxBackoff {
+		wait = s.cfg.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (s *supervisor) fail(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	select {
+	case failures <- err:
+	default:
+	}
+}
+
+func (s *supervisor) failure() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// protect turns a panic in a client into an error.
+func protect(start func() error) (err error) {
+	defer Recover(&err)
+	return start()
+}
+
+// Recover turns a panic into an error stored in err. Clients defer it in the
+// goroutines they start, and hand the error back to Start, as a panic is
+// only recovered in the goroutine it happens in.
+func Recover(err *error) {
+	if r := recover(); r != nil {
+		logging.Error("Recovered from panic", "panic", r, "stack", string(debug.Stack()))
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
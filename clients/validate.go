@@ -0,0 +1,67 @@
+package clients
+
+import (
+	"fmt"
+	"strings"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/filter"
+	"traefik-cert-aggregator/util"
+)
+
+// Validate checks a configuration against the schemas of the registered
+// clients, without configuring or starting any of them.
+func Validate(cfg *config.Config) []error {
+	problems := validateKind(KindImporter, cfg.EnabledImporters, cfg.ImporterConfig)
+	problems = append(problems, validateKind(KindExporter, cfg.EnabledExporters, cfg.ExporterConfig)...)
+
+	enabledImporters := make(map[string]bool)
+	for _, name := range cfg.EnabledImporters {
+		enabledImporters[strings.ToLower(name)] = true
+	}
+	enabledExporters := make(map[string]bool)
+	for _, name := range cfg.EnabledExporters {
+		enabledExporters[strings.ToLower(name)] = true
+	}
+	for importer, exporters := range cfg.Routes {
+		if !enabledImporters[strings.ToLower(importer)] {
+			problems = append(problems, fmt.Errorf("route from importer \"%s\", which is not enabled", importer))
+		}
+		for _, exporter := range exporters {
+			if !enabledExporters[strings.ToLower(exporter)] {
+				problems = append(problems, fmt.Errorf("route to exporter \"%s\", which is not enabled", exporter))
+			}
+		}
+	}
+	return problems
+}
+
+func validateKind(kind string, enabled []string, cfg config.KeyedKVMap) []error {
+	var problems []error
+	names := enabledNames(enabled)
+	isEnabled := util.NewSetFromArray(names)
+	for _, name := range names {
+		c, err := instance(kind, name, cfg[name])
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		cc, err := c.GetInfo().Prepare(cfg[name])
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s \"%s\": %s", kind, name, err))
+			continue
+		}
+		_, err = filter.Parse(cc["includeDomains"], cc["excludeDomains"])
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s \"%s\": %s", kind, name, err))
+		}
+	}
+	for name, cc := range cfg {
+		if isEnabled.Contains(name) {
+			continue
+		}
+		if _, err := instance(kind, name, cc); err != nil {
+			problems = append(problems, fmt.Errorf("configuration for %s", err))
+		}
+	}
+	return problems
+}
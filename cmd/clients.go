@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"traefik-cert-aggregator/clients"
+	clientConfig "traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/clients/exporters"
+	"traefik-cert-aggregator/clients/importers"
+	"traefik-cert-aggregator/config"
+)
+
+// listClients prints every importer and exporter built into the binary.
+func listClients(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: cert-agg list-clients")
+		return 2
+	}
+	addAllClients()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME")
+	for _, c := range clients.ImportClients() {
+		fmt.Fprintf(w, "%s\t%s\n", clients.KindImporter, c.GetInfo().Type)
+	}
+	for _, c := range clients.ExportClients() {
+		fmt.Fprintf(w, "%s\t%s\n", clients.KindExporter, c.GetInfo().Type)
+	}
+	w.Flush()
+	return 0
+}
+
+// describe prints the settings a client understands. Importers and exporters
+// can share a name, in which case the kind has to be given as well.
+func describe(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cert-agg describe <name|importer/name|exporter/name>")
+		return 2
+	}
+	kind, name := "", args[0]
+	if i := strings.Index(name, "/"); i >= 0 {
+		kind, name = name[:i], name[i+1:]
+	}
+	addAllClients()
+
+	var found []clients.Client
+	var kinds []string
+	if kind == "" || kind == clients.KindImporter {
+		for _, c := range clients.ImportClients() {
+			if strings.EqualFold(c.GetInfo().Type, name) {
+				found = append(found, c)
+				kinds = append(kinds, clients.KindImporter)
+			}
+		}
+	}
+	if kind == "" || kind == clients.KindExporter {
+		for _, c := range clients.ExportClients() {
+			if strings.EqualFold(c.GetInfo().Type, name) {
+				found = append(found, c)
+				kinds = append(kinds, clients.KindExporter)
+			}
+		}
+	}
+	if len(found) == 0 {
+		fmt.Fprintf(os.Stderr, "No client \"%s\", see cert-agg list-clients\n", args[0])
+		return 1
+	}
+
+	for i, c := range found {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s %s\n\n", kinds[i], c.GetInfo().Type)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tTYPE\tDEFAULT\tDESCRIPTION")
+		for _, key := range c.GetInfo().Keys() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Key, key.Type, describeDefault(key), key.Description)
+		}
+		w.Flush()
+	}
+	return 0
+}
+
+func describeDefault(key clientConfig.ConfigKey) string {
+	switch {
+	case key.Required:
+		return "(required)"
+	case key.Default == "":
+		return "-"
+	case key.Secret:
+		return "(set)"
+	}
+	return key.Default
+}
+
+// addAllClients registers the clients without configuring any of them.
+func addAllClients() {
+	importers.AddAllClients(config.Config{})
+	exporters.AddAllClients(config.Config{})
+}
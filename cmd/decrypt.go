@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/encryption"
+)
+
+// decrypt prints a key encrypted by an exporter, or a state file with every
+// key decrypted, using the configured key encryption.
+func decrypt(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cert-agg decrypt <key file|state file|->")
+		return 2
+	}
+	var raw []byte
+	var err error
+	if args[0] == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read input: %s\n", err)
+		return 1
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load config: %s\n", err)
+		return 1
+	}
+	ks, err := encryption.FromConfig(cfg.Encryption)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up key encryption: %s\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var out []byte
+	if encryption.IsSealed(raw) {
+		out, err = encryption.Open(ctx, ks, raw)
+	} else {
+		out, err = aggregator.OpenState(ctx, raw, ks)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not decrypt: %s\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"traefik-cert-aggregator/config"
+)
+
+func getEnv(name string) string {
+	return os.Getenv(name)
+}
+
+func getEnvDefault(name string, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+func getEnvInt(name string, def int) int {
+	val, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvFloat(name string, def float64) float64 {
+	val, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvBool(name string, def bool) bool {
+	val, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	val, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvList(name string, def []string) []string {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	return strings.Split(val, ",")
+}
+
+// getEnvRoutes parses a routing table like "vault=traefik,stdout;kubernetes=sds".
+func getEnvRoutes(name string) map[string][]string {
+	val := os.Getenv(name)
+	if val == "" {
+		return nil
+	}
+	routes := make(map[string][]string)
+	for _, route := range strings.Split(val, ";") {
+		importer, exporters, _ := strings.Cut(route, "=")
+		importer = strings.TrimSpace(importer)
+		for _, exporter := range strings.Split(exporters, ",") {
+			if exporter = strings.TrimSpace(exporter); exporter != "" {
+				routes[importer] = append(routes[importer], exporter)
+			}
+		}
+	}
+	return routes
+}
+
+// addCommonKeys reads the settings shared between clients from variables
+// like EXPORTER_TRAEFIK_INCLUDE_DOMAINS.
+func addCommonKeys(prefix string, clientConfigs config.KeyedKVMap) {
+	for name, cc := range clientConfigs {
+		envName := strings.ToUpper(prefix + "_" + name)
+		if val := getEnv(envName + "_INCLUDE_DOMAINS"); val != "" {
+			cc["includeDomains"] = val
+		}
+		if val := getEnv(envName + "_EXCLUDE_DOMAINS"); val != "" {
+			cc["excludeDomains"] = val
+		}
+		if val := getEnv(envName + "_CRITICAL"); val != "" {
+			cc["critical"] = val
+		}
+		if val := getEnv(envName + "_LEADER_ONLY"); val != "" {
+			cc["leaderOnly"] = val
+		}
+		if val := getEnv(envName + "_LOG_LEVEL"); val != "" {
+			cc["logLevel"] = val
+		}
+	}
+}
+
+// loadConfig reads the file named by CONFIG_FILE, falling back to
+// configuration from environment variables.
+func loadConfig() (config.Config, error) {
+	if name := getEnv("CONFIG_FILE"); name != "" {
+		cfg, err := config.LoadFile(name)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ReloadInterval = getEnvDuration("CONFIG_RELOAD_INTERVAL", cfg.ReloadInterval)
+		return cfg, nil
+	}
+	return configFromEnv(), nil
+}
+
+func configFromEnv() config.Config {
+	cfg := config.Load()
+	cfg.EnabledImporters = getEnvList("ENABLED_IMPORTERS", []string{"vault"})
+	cfg.EnabledExporters = getEnvList("ENABLED_EXPORTERS", []string{"stdout", "traefik"})
+	cfg.ImporterConfig = config.KeyedKVMap{
+		"vault": map[string]string{
+			"token": getEnv("VAULT_TOKEN"),
+			"addr":  getEnv("VAULT_ADDR"),
+		},
+		"kubernetes": map[string]string{
+			"kubeconfig": getEnv("KUBECONFIG"),
+			"namespaces": getEnv("KUBERNETES_WATCH_NAMESPACES"),
+		},
+	}
+	cfg.ExporterConfig = config.KeyedKVMap{
+		"stdout": map[string]string{
+			"prefix": "Stat exporter: ",
+		},
+		"traefik": map[string]string{
+			"baseLocation": getEnv("TRAEFIK_BASE"),
+		},
+		"sds": map[string]string{
+			"listen":   getEnvDefault("SDS_LISTEN", "127.0.0.1:18000"),
+			"tlsCert":  getEnv("SDS_TLS_CERT"),
+			"tlsKey":   getEnv("SDS_TLS_KEY"),
+			"clientCA": getEnv("SDS_CLIENT_CA"),
+		},
+		"kubernetes": map[string]string{
+			"kubeconfig": getEnv("KUBECONFIG"),
+			"namespaces": getEnvDefault("KUBERNETES_NAMESPACES", "default"),
+		},
+		"vault": map[string]string{
+			"token":        getEnv("VAULT_TOKEN"),
+			"addr":         getEnv("VAULT_ADDR"),
+			"pathTemplate": getEnvDefault("VAULT_EXPORT_PATH", "infrastructure/aggregated-certs/{{.CommonName}}"),
+		},
+		"exec": map[string]string{
+			"baseLocation": getEnv("EXEC_BASE"),
+			"command":      getEnv("EXEC_COMMAND"),
+			"domains":      getEnv("EXEC_DOMAINS"),
+		},
+		"webhook": map[string]string{
+			"url":    getEnv("WEBHOOK_URL"),
+			"secret": getEnv("WEBHOOK_SECRET"),
+			"outbox": getEnv("WEBHOOK_OUTBOX"),
+		},
+	}
+
+	addCommonKeys("importer", cfg.ImporterConfig)
+	addCommonKeys("exporter", cfg.ExporterConfig)
+
+	cfg.Routes = getEnvRoutes("ROUTES")
+	cfg.NormalizeNames()
+	cfg.Supervisor.InitialBackoff = getEnvDuration("CLIENT_BACKOFF_INITIAL", cfg.Supervisor.InitialBackoff)
+	cfg.Supervisor.MaxBackoff = getEnvDuration("CLIENT_BACKOFF_MAX", cfg.Supervisor.MaxBackoff)
+	cfg.Supervisor.MaxFailures = getEnvInt("CLIENT_MAX_FAILURES", cfg.Supervisor.MaxFailures)
+	cfg.HttpAddr = getEnv("HTTP_ADDR")
+	cfg.AdminToken = getEnv("ADMIN_TOKEN")
+	cfg.StateFile = getEnv("STATE_FILE")
+	cfg.ShutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout)
+	cfg.ReloadInterval = getEnvDuration("CONFIG_RELOAD_INTERVAL", cfg.ReloadInterval)
+	cfg.Encryption = config.EncryptionConfig{
+		Source:          getEnv("KEY_ENCRYPTION"),
+		KeyFile:         getEnv("KEY_ENCRYPTION_FILE"),
+		TransitMount:    getEnv("KEY_ENCRYPTION_TRANSIT_MOUNT"),
+		TransitKey:      getEnv("KEY_ENCRYPTION_TRANSIT_KEY"),
+		TransitAddr:     getEnv("KEY_ENCRYPTION_TRANSIT_ADDR"),
+		TransitToken:    getEnv("KEY_ENCRYPTION_TRANSIT_TOKEN"),
+		AgeRecipients:   getEnvList("KEY_ENCRYPTION_AGE_RECIPIENTS", nil),
+		AgeIdentityFile: getEnv("KEY_ENCRYPTION_AGE_IDENTITY"),
+	}
+	cfg.LeaderElection = config.LeaderConfig{
+		Backend:    getEnv("LEADER_ELECTION"),
+		Key:        getEnvDefault("LEADER_KEY", cfg.LeaderElection.Key),
+		TTL:        getEnvDuration("LEADER_TTL", cfg.LeaderElection.TTL),
+		ID:         getEnv("LEADER_ID"),
+		VaultMount: getEnvDefault("LEADER_VAULT_MOUNT", cfg.LeaderElection.VaultMount),
+		Addr:       getEnv("LEADER_ADDR"),
+		Token:      getEnv("LEADER_TOKEN"),
+	}
+	cfg.Logging = config.LoggingConfig{
+		Level:  getEnvDefault("LOG_LEVEL", cfg.Logging.Level),
+		Format: getEnvDefault("LOG_FORMAT", cfg.Logging.Format),
+	}
+	cfg.Tracing = config.TracingConfig{
+		Endpoint:    getEnv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		Protocol:    getEnvDefault("OTEL_EXPORTER_OTLP_PROTOCOL", cfg.Tracing.Protocol),
+		Insecure:    getEnvBool("OTEL_EXPORTER_OTLP_INSECURE", cfg.Tracing.Insecure),
+		ServiceName: getEnvDefault("OTEL_SERVICE_NAME", cfg.Tracing.ServiceName),
+		SampleRatio: getEnvFloat("OTEL_TRACES_SAMPLER_ARG", cfg.Tracing.SampleRatio),
+	}
+	cfg.ExpiryWarningDays = getEnvInt("EXPIRY_WARNING_DAYS", cfg.ExpiryWarningDays)
+	cfg.ExpiryCriticalDays = getEnvInt("EXPIRY_CRITICAL_DAYS", cfg.ExpiryCriticalDays)
+	cfg.AlertWebhookUrl = getEnv("ALERT_WEBHOOK_URL")
+	cfg.SmtpAddr = getEnv("SMTP_ADDR")
+	cfg.SmtpFrom = getEnv("SMTP_FROM")
+	cfg.SmtpTo = getEnvList("SMTP_TO", nil)
+	cfg.SmtpUsername = getEnv("SMTP_USERNAME")
+	cfg.SmtpPassword = getEnv("SMTP_PASSWORD")
+	cfg.WithholdExpired = getEnvBool("WITHHOLD_EXPIRED", false)
+	cfg.ExpiredGracePeriod = getEnvDuration("EXPIRED_GRACE_PERIOD", 0)
+	cfg.KeepLastExpired = getEnvBool("KEEP_LAST_EXPIRED", false)
+	return cfg
+}
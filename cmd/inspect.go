@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/importers"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/util"
+)
+
+type chainEntry struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"notAfter"`
+	CA          bool      `json:"ca"`
+}
+
+type certReport struct {
+	Subject     string       `json:"subject"`
+	SANs        []string     `json:"sans"`
+	Issuer      string       `json:"issuer"`
+	Serial      string       `json:"serial"`
+	Fingerprint string       `json:"fingerprint"`
+	KeyType     string       `json:"keyType"`
+	KeySize     int          `json:"keySize"`
+	NotBefore   time.Time    `json:"notBefore"`
+	NotAfter    time.Time    `json:"notAfter"`
+	Chain       []chainEntry `json:"chain"`
+	Problems    []string     `json:"problems"`
+}
+
+type inspectReport struct {
+	Certificates []certReport       `json:"certificates"`
+	Rejected     []clients.Rejected `json:"rejected"`
+}
+
+// inspect prints what an importer holds, with any problems it can find.
+func inspect(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	importer := flags.String("importer", "", "importer to poll, defaults to the only enabled one")
+	domain := flags.String("domain", "", "only show certificates covering this domain, globs are allowed")
+	asJson := flags.Bool("json", false, "print JSON")
+	rootsFile := flags.String("roots", "", "PEM file with the roots chains have to end at, instead of the system roots")
+	noRoots := flags.Bool("no-roots", false, "do not check that chains end at a trusted root")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cert-agg inspect [--importer name] [--domain name] [--roots file | --no-roots] [--json]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logging.Fatal("Could not load config", "error", err)
+	}
+	if err := configureLogging(cfg); err != nil {
+		logging.Fatal("Could not configure logging", "error", err)
+	}
+	if *importer == "" {
+		if len(cfg.EnabledImporters) == 0 {
+			fmt.Fprintln(os.Stderr, "No importer is enabled")
+			return 2
+		}
+		if len(cfg.EnabledImporters) > 1 {
+			fmt.Fprintln(os.Stderr, "More than one importer is enabled, pick one with --importer")
+			return 2
+		}
+		*importer = cfg.EnabledImporters[0]
+	}
+	importers.AddAllClients(cfg)
+
+	check := rootCheck{enabled: !*noRoots}
+	if *rootsFile != "" {
+		raw, err := os.ReadFile(*rootsFile)
+		if err != nil {
+			logging.Error("Could not read roots", "file", *rootsFile, "error", err)
+			return 2
+		}
+		check.roots = x509.NewCertPool()
+		if !check.roots.AppendCertsFromPEM(raw) {
+			logging.Error("No certificates found in roots", "file", *rootsFile)
+			return 2
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	certs, rejected, err := clients.Inspect(ctx, &cfg, *importer)
+	if err != nil {
+		logging.Error("Could not poll importer", "importer", *importer, "error", err)
+		return 1
+	}
+
+	reports := []certReport{}
+	now := time.Now()
+	for _, cp := range certs {
+		if *domain != "" && !coversDomain(cp, *domain) {
+			continue
+		}
+		reports = append(reports, newCertReport(cp, now, check))
+	}
+	if rejected == nil {
+		rejected = []clients.Rejected{}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Subject != reports[j].Subject {
+			return reports[i].Subject < reports[j].Subject
+		}
+		return reports[i].NotAfter.Before(reports[j].NotAfter)
+	})
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(inspectReport{Certificates: reports, Rejected: rejected})
+	} else {
+		printCertReports(os.Stdout, reports, now)
+		printRejected(os.Stdout, rejected)
+	}
+	if len(rejected) > 0 {
+		return 1
+	}
+	for _, report := range reports {
+		if len(report.Problems) > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// coversDomain matches the certificate's names against a domain, either of
+// which may contain wildcards.
+func coversDomain(cp aggregator.CertPackage, domain string) bool {
+	for _, name := range cp.Domains() {
+		if util.MatchDomain(name, domain) || util.MatchDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rootCheck says whether, and against which roots, a chain is verified. Nil
+// roots are the system roots.
+type rootCheck struct {
+	enabled bool
+	roots   *x509.CertPool
+}
+
+func newCertReport(cp aggregator.CertPackage, now time.Time, check rootCheck) certReport {
+	report := certReport{
+		Subject:     cp.Cert.Subject.String(),
+		SANs:        sans(cp.Cert),
+		Issuer:      cp.Cert.Issuer.String(),
+		Serial:      cp.Cert.SerialNumber.String(),
+		Fingerprint: cp.Fingerprint(),
+		NotBefore:   cp.Cert.NotBefore,
+		NotAfter:    cp.Cert.NotAfter,
+		Chain:       []chainEntry{},
+		Problems:    []string{},
+	}
+	report.KeyType, report.KeySize = publicKeyInfo(cp.Cert.PublicKey)
+	for _, cert := range cp.Chain {
+		sum := sha256.Sum256(cert.Raw)
+		report.Chain = append(report.Chain, chainEntry{
+			Subject:     cert.Subject.String(),
+			Issuer:      cert.Issuer.String(),
+			Serial:      cert.SerialNumber.String(),
+			Fingerprint: hex.EncodeToString(sum[:]),
+			NotAfter:    cert.NotAfter,
+			CA:          cert.IsCA,
+		})
+	}
+	report.Problems = append(report.Problems, certProblems(cp, now, check)...)
+	return report
+}
+
+func sans(cert *x509.Certificate) []string {
+	ret := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		ret = append(ret, ip.String())
+	}
+	ret = append(ret, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		ret = append(ret, uri.String())
+	}
+	return ret
+}
+
+func publicKeyInfo(key interface{}) (string, int) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name, k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return "unknown", 0
+}
+
+// certProblems finds what would make a client reject the certificate.
+func certProblems(cp aggregator.CertPackage, now time.Time, check rootCheck) []string {
+	var problems []string
+	if cp.Key == nil {
+		problems = append(problems, "no private key")
+	} else if pub, ok := cp.Key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cp.Cert.PublicKey) {
+		problems = append(problems, "private key does not match the certificate")
+	}
+
+	if now.Before(cp.Cert.NotBefore) {
+		problems = append(problems, fmt.Sprintf("not valid before %s", cp.Cert.NotBefore.Format(time.RFC3339)))
+	}
+	if now.After(cp.Cert.NotAfter) {
+		problems = append(problems, fmt.Sprintf("expired at %s", cp.Cert.NotAfter.Format(time.RFC3339)))
+	}
+
+	for i := 0; i+1 < len(cp.Chain); i++ {
+		if cp.Chain[i].CheckSignatureFrom(cp.Chain[i+1]) != nil {
+			problems = append(problems, fmt.Sprintf("chain certificate %d (%s) is not issued by certificate %d (%s), the chain is out of order or incomplete",
+				i, cp.Chain[i].Subject.CommonName, i+1, cp.Chain[i+1].Subject.CommonName))
+		}
+	}
+
+	if !check.enabled {
+		return problems
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cp.Chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cp.Cert.Verify(x509.VerifyOptions{Roots: check.roots, Intermediates: intermediates, CurrentTime: cp.Cert.NotBefore.Add(time.Second)})
+	var unknown x509.UnknownAuthorityError
+	if errors.As(err, &unknown) {
+		last := cp.Chain[len(cp.Chain)-1]
+		if last.IsCA {
+			problems = append(problems, fmt.Sprintf("chain ends at \"%s\", whose issuer \"%s\" is not a trusted root", last.Subject.CommonName, last.Issuer.CommonName))
+		} else {
+			problems = append(problems, fmt.Sprintf("chain has no intermediates, the one issued to \"%s\" is missing", last.Issuer.CommonName))
+		}
+	} else if err != nil {
+		problems = append(problems, fmt.Sprintf("chain does not verify: %s", err))
+	}
+	return problems
+}
+
+func printCertReports(w io.Writer, reports []certReport, now time.Time) {
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "No certificates found")
+	}
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Subject:      %s\n", report.Subject)
+		fmt.Fprintf(w, "SANs:         %s\n", strings.Join(report.SANs, ", "))
+		fmt.Fprintf(w, "Issuer:       %s\n", report.Issuer)
+		fmt.Fprintf(w, "Serial:       %s\n", report.Serial)
+		fmt.Fprintf(w, "Fingerprint:  %s\n", report.Fingerprint)
+		fmt.Fprintf(w, "Key:          %s %d\n", report.KeyType, report.KeySize)
+		fmt.Fprintf(w, "Valid:        %s to %s (%d days left)\n", report.NotBefore.Format(time.RFC3339), report.NotAfter.Format(time.RFC3339), int(report.NotAfter.Sub(now).Hours()/24))
+		fmt.Fprintln(w, "Chain:")
+		for j, entry := range report.Chain {
+			fmt.Fprintf(w, "  %d: %s\n     issued by %s, expires %s\n", j, entry.Subject, entry.Issuer, entry.NotAfter.Format(time.RFC3339))
+		}
+		if len(report.Problems) == 0 {
+			fmt.Fprintln(w, "Problems:     none")
+			continue
+		}
+		fmt.Fprintln(w, "Problems:")
+		for _, problem := range report.Problems {
+			fmt.Fprintf(w, "  - %s\n", problem)
+		}
+	}
+}
+
+func printRejected(w io.Writer, rejected []clients.Rejected) {
+	if len(rejected) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Secrets that could not be used:")
+	for _, r := range rejected {
+		fmt.Fprintf(w, "  - %s: %s\n", r.Source, r.Error)
+	}
+}
@@ -1,76 +1,44 @@
 package main
 
 import (
-	"context"
-	"log"
+	"fmt"
 	"os"
-	"os/signal"
-	"sync"
-	"time"
-	"traefik-cert-aggregator/aggregator"
-	"traefik-cert-aggregator/clients"
-	"traefik-cert-aggregator/clients/exporters"
-	"traefik-cert-aggregator/clients/importers"
-	"traefik-cert-aggregator/config"
 )
-func getEnv(name string) string {
-	return os.Getenv(name)
+
+var commands = map[string]func([]string) int{
+	"run":          run,
+	"once":         once,
+	"validate":     validate,
+	"list-clients": listClients,
+	"describe":     describe,
+	"inspect":      inspect,
+	"decrypt":      decrypt,
 }
 
+const usage = `usage: cert-agg [command] [args]
+
+commands:
+  run                    keep the exporters in sync (default)
+  once [--dry-run]       poll every importer once, export and exit
+  validate [file]        check the configuration without starting anything
+  list-clients           list the available importers and exporters
+  describe <client>      print the settings a client understands
+  inspect [--importer]   print what an importer holds, with any problems found
+  decrypt <file|->       decrypt an exported key or a state file`
+
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	wg := sync.WaitGroup{}
-	cfg := config.Load()
-	cfg.EnabledImporters = []string{"vault"}
-	cfg.EnabledExporters = []string{"stdout", "traefik"}
-	cfg.ImporterConfig = config.KeyedKVMap{
-		"vault": map[string]string{
-			"token": getEnv("VAULT_TOKEN"),
-			"addr":  getEnv("VAULT_ADDR"),
-		},
+	if len(os.Args) < 2 {
+		os.Exit(run(nil))
 	}
-	cfg.ExporterConfig = config.KeyedKVMap{
-		"stdout": map[string]string{
-			"prefix": "Stat exporter: ",
-		},
-		"traefik": map[string]string{
-			"baseLocation": getEnv("TRAEFIK_BASE"),
-		},
+	switch os.Args[1] {
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return
 	}
-
-	importers.AddAllClients(cfg)
-	exporters.AddAllClients(cfg)
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-
-		err := clients.StartClients(&ctx, &cfg)
-		if err != nil {
-			log.Printf("Clients failed to configure: %s", err)
-			cancel()
-
-		}
-	}()
-
-	go func() {
-		aggregator.StartAggregating(ctx)
-		wg.Done()
-	}()
-
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt)
-	select {
-	case <-c:
-		log.Printf("Got interupt. Cancelling executing goroutines")
-		cancel()
-		go func() {
-			<- time.After(5*time.Second)
-			panic("")
-		}()
-	case <-ctx.Done():
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command \"%s\"\n\n%s\n", os.Args[1], usage)
+		os.Exit(2)
 	}
-
-	wg.Wait()
-	log.Println("Bye!")
-
+	os.Exit(command(os.Args[2:]))
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/logging"
+)
+
+// once polls every importer a single time and exports the result, for
+// running from cron or CI.
+func once(args []string) int {
+	flags := flag.NewFlagSet("once", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print what the exporters would do instead of doing it")
+	asJson := flags.Bool("json", false, "print the dry run plan as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cert-agg once [--dry-run [--json]]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logging.Fatal("Could not load config", "error", err)
+	}
+	if *dryRun {
+		// Certificates restored from the state file and no longer imported
+		// show up as removed, but the file itself is left as it is
+		aggregator.SetStateReadOnly()
+	}
+	defer setup(cfg)()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *dryRun {
+		plans, err := clients.DryRun(ctx, &cfg)
+		if err != nil {
+			logging.Error("Dry run failed", "error", err)
+			return 1
+		}
+		if *asJson {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(plans)
+		} else {
+			printPlans(os.Stdout, plans)
+		}
+		for _, plan := range plans {
+			if plan.Error != "" {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	err = clients.RunOnce(ctx, &cfg)
+	if err != nil {
+		logging.Error("Run failed", "error", err)
+		return 1
+	}
+	logging.Info("Run finished")
+	return 0
+}
+
+func printPlans(w io.Writer, plans []clients.Plan) {
+	for i, plan := range plans {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "exporter %s\n", plan.Exporter)
+		for _, change := range plan.Changes {
+			fmt.Fprintf(w, "  from %s: %d added, %d removed\n", change.Sender, len(change.Added), len(change.Removed))
+			for _, name := range change.Added {
+				fmt.Fprintf(w, "    + %s\n", name)
+			}
+			for _, name := range change.Removed {
+				fmt.Fprintf(w, "    - %s\n", name)
+			}
+		}
+		if plan.Error != "" {
+			fmt.Fprintf(w, "  could not plan: %s\n", plan.Error)
+			continue
+		}
+		if len(plan.Steps) == 0 {
+			fmt.Fprintln(w, "  no changes")
+		}
+		for _, step := range plan.Steps {
+			fmt.Fprintf(w, "  %-7s %s", step.Action, step.Target)
+			if step.Detail != "" {
+				fmt.Fprintf(w, " (%s)", step.Detail)
+			}
+			fmt.Fprintln(w)
+			if step.Diff != "" {
+				for _, line := range strings.Split(strings.TrimSuffix(step.Diff, "\n"), "\n") {
+					fmt.Fprintf(w, "    %s\n", line)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/logging"
+)
+
+// reload re-reads the configuration and applies it to the running clients.
+// Settings which are only read at startup are compared with the config the
+// process was started with.
+func reload(started config.Config) {
+	logging.Info("Reloading configuration")
+	cfg, err := loadConfig()
+	if err != nil {
+		logging.Error("Could not reload config, keeping the current one", "error", err)
+		return
+	}
+	for _, setting := range restartRequired(started, cfg) {
+		logging.Warn("Setting changed, this takes effect after a restart", "setting", setting)
+	}
+	err = configureLogging(cfg)
+	if err != nil {
+		logging.Error("Could not reconfigure logging, keeping the current settings", "error", err)
+	}
+
+	aggregator.SetExpiryPolicy(aggregator.ExpiryPolicy{
+		Withhold: cfg.WithholdExpired,
+		Grace:    cfg.ExpiredGracePeriod,
+		KeepLast: cfg.KeepLastExpired,
+	})
+	err = clients.Reload(&cfg)
+	if err != nil {
+		logging.Error("Could not reload clients", "error", err)
+	}
+}
+
+func restartRequired(started config.Config, cfg config.Config) []string {
+	settings := map[string][2]interface{}{
+		"httpAddr":        {started.HttpAddr, cfg.HttpAddr},
+		"adminToken":      {started.AdminToken, cfg.AdminToken},
+		"stateFile":       {started.StateFile, cfg.StateFile},
+		"encryption":      {started.Encryption, cfg.Encryption},
+		"supervisor":      {started.Supervisor, cfg.Supervisor},
+		"leaderElection":  {started.LeaderElection, cfg.LeaderElection},
+		"tracing":         {started.Tracing, cfg.Tracing},
+		"shutdownTimeout": {started.ShutdownTimeout, cfg.ShutdownTimeout},
+		"reloadInterval":  {started.ReloadInterval, cfg.ReloadInterval},
+		"expiry alerts": {
+			[]interface{}{started.ExpiryWarningDays, started.ExpiryCriticalDays, started.AlertWebhookUrl, started.SmtpAddr, started.SmtpFrom, started.SmtpTo, started.SmtpUsername, started.SmtpPassword},
+			[]interface{}{cfg.ExpiryWarningDays, cfg.ExpiryCriticalDays, cfg.AlertWebhookUrl, cfg.SmtpAddr, cfg.SmtpFrom, cfg.SmtpTo, cfg.SmtpUsername, cfg.SmtpPassword},
+		},
+	}
+	var changed []string
+	for name, values := range settings {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// watchConfigFile signals whenever the modification time of the config file
+// changes.
+func watchConfigFile(ctx context.Context, name string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	var lastMod time.Time
+	if info, err := os.Stat(name); err == nil {
+		lastMod = info.ModTime()
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			info, err := os.Stat(name)
+			if err != nil || info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
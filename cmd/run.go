@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/api"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/exporters"
+	"traefik-cert-aggregator/clients/importers"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/encryption"
+	"traefik-cert-aggregator/expiry"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/notify"
+	"traefik-cert-aggregator/server"
+	"traefik-cert-aggregator/tracing"
+	"traefik-cert-aggregator/util"
+)
+
+// run is the daemon, it keeps the exporters in sync until it is stopped.
+func run(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: cert-agg run")
+		return 2
+	}
+
+	// Exporters get their own context, so they can drain what is left in
+	// their channels after everything else was stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	exportCtx, cancelExport := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	cfg, err := loadConfig()
+	if err != nil {
+		logging.Fatal("Could not load config", "error", err)
+	}
+
+	shutdownTracing := setup(cfg)
+	defer shutdownTracing()
+	startErr := make(chan error, 1)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		err := clients.StartClients(&ctx, &exportCtx, &cfg)
+		if err != nil {
+			startErr <- err
+		}
+	}()
+
+	go func() {
+		aggregator.StartAggregating(ctx)
+		wg.Done()
+	}()
+
+	monitor := expiry.Monitor{
+		Warning:  time.Duration(cfg.ExpiryWarningDays) * 24 * time.Hour,
+		Critical: time.Duration(cfg.ExpiryCriticalDays) * 24 * time.Hour,
+		Interval: 10 * time.Minute,
+	}
+	if cfg.AlertWebhookUrl != "" {
+		monitor.Notifiers = append(monitor.Notifiers, notify.NewWebhookNotifier(cfg.AlertWebhookUrl))
+	}
+	if cfg.SmtpAddr != "" {
+		monitor.Notifiers = append(monitor.Notifiers, notify.NewSmtpNotifier(cfg.SmtpAddr, cfg.SmtpFrom, cfg.SmtpTo, cfg.SmtpUsername, cfg.SmtpPassword))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		monitor.Run(ctx)
+	}()
+
+	if cfg.HttpAddr != "" {
+		server.Handle("/metrics", metrics.Handler())
+		server.Handle("/healthz", api.HealthHandler(cfg.AdminToken))
+		server.Handle("/readyz", api.ReadyHandler(cfg.AdminToken))
+		if cfg.AdminToken != "" {
+			server.Handle("/api/certificates", api.Authenticated(cfg.AdminToken, api.CertificatesHandler()))
+			server.Handle("/api/certificates/", api.Authenticated(cfg.AdminToken, api.CertificatesHandler()))
+			server.Handle("/api/changes", api.Authenticated(cfg.AdminToken, api.ChangesHandler()))
+		} else {
+			logging.Info("No admin token configured, the admin API is disabled")
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := server.ListenAndServe(ctx, cfg.HttpAddr)
+			if err != nil {
+				logging.Error("HTTP server failed", "error", err)
+			}
+		}()
+	}
+
+	var configChanges <-chan struct{}
+	if name := getEnv("CONFIG_FILE"); name != "" && cfg.ReloadInterval > 0 {
+		configChanges = watchConfigFile(ctx, name, cfg.ReloadInterval)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	exitCode := 0
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+waitLoop:
+	for {
+		select {
+		case <-hup:
+			reload(cfg)
+		case <-configChanges:
+			reload(cfg)
+		case sig := <-c:
+			logging.Info("Got signal, cancelling executing goroutines", "signal", sig)
+			break waitLoop
+		case err := <-clients.Failures():
+			logging.Error("Shutting down", "error", err)
+			exitCode = 1
+			break waitLoop
+		case err := <-startErr:
+			logging.Error("Clients failed", "error", err)
+			exitCode = 1
+			break waitLoop
+		}
+	}
+	cancel()
+
+	done := util.WaitGroupToChannel(&wg)
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout):
+		logging.Warn("Exporters did not finish in time, abandoning pending changes", "timeout", cfg.ShutdownTimeout)
+		exitCode = 1
+		cancelExport()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			logging.Warn("Clients did not stop, exiting anyway")
+		}
+	case <-c:
+		logging.Warn("Got second signal, exiting without waiting for exporters")
+		exitCode = 1
+	}
+	cancelExport()
+	logging.Info("Bye!")
+	return exitCode
+}
+
+// setup prepares everything the clients rely on. The returned function
+// flushes the spans which were not sent yet.
+func setup(cfg config.Config) func() {
+	err := configureLogging(cfg)
+	if err != nil {
+		logging.Fatal("Could not configure logging", "error", err)
+	}
+	flush, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Could not set up tracing", "error", err)
+	}
+	aggregator.SetExpiryPolicy(aggregator.ExpiryPolicy{
+		Withhold: cfg.WithholdExpired,
+		Grace:    cfg.ExpiredGracePeriod,
+		KeepLast: cfg.KeepLastExpired,
+	})
+
+	ks, err := encryption.FromConfig(cfg.Encryption)
+	if err != nil {
+		logging.Fatal("Could not set up key encryption", "error", err)
+	}
+	encryption.SetDefault(ks)
+
+	if cfg.StateFile != "" {
+		err = aggregator.LoadState(cfg.StateFile)
+		if err != nil {
+			logging.Fatal("Could not load state", "file", cfg.StateFile, "error", err)
+		}
+	}
+
+	importers.AddAllClients(cfg)
+	exporters.AddAllClients(cfg)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := flush(ctx); err != nil {
+			logging.Warn("Could not flush traces", "error", err)
+		}
+	}
+}
+
+// configureLogging applies the log settings, and makes sure the secrets
+// which are not part of a client's configuration never show up in logs.
+func configureLogging(cfg config.Config) error {
+	for _, secret := range []string{cfg.AdminToken, cfg.SmtpPassword, cfg.Encryption.TransitToken, cfg.LeaderElection.Token, getEnv("VAULT_TOKEN"), getEnv("CONSUL_HTTP_TOKEN")} {
+		logging.AddSecret(secret)
+	}
+	return logging.Configure(cfg.Logging.Level, cfg.Logging.Format)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"traefik-cert-aggregator/clients"
+	"traefik-cert-aggregator/clients/exporters"
+	"traefik-cert-aggregator/clients/importers"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/encryption"
+	"traefik-cert-aggregator/leader"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/tracing"
+)
+
+// validate checks a config file, or the configuration from the environment,
+// without starting anything.
+func validate(args []string) int {
+	var cfg config.Config
+	var err error
+	switch len(args) {
+	case 0:
+		cfg, err = loadConfig()
+	case 1:
+		cfg, err = config.LoadFile(args[0])
+	default:
+		fmt.Fprintln(os.Stderr, "usage: cert-agg validate [config file]")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load config: %s\n", err)
+		return 1
+	}
+
+	importers.AddAllClients(cfg)
+	exporters.AddAllClients(cfg)
+	problems := clients.Validate(&cfg)
+	if _, err := encryption.FromConfig(cfg.Encryption); err != nil {
+		problems = append(problems, fmt.Errorf("encryption: %s", err))
+	}
+	if _, err := leader.FromConfig(cfg.LeaderElection); err != nil {
+		problems = append(problems, fmt.Errorf("leader election: %s", err))
+	}
+	if _, err := logging.ParseLevel(cfg.Logging.Level); err != nil {
+		problems = append(problems, fmt.Errorf("logging: %s", err))
+	}
+	if _, err := logging.ParseFormat(cfg.Logging.Format); err != nil {
+		problems = append(problems, fmt.Errorf("logging: %s", err))
+	}
+	if err := tracing.Validate(cfg.Tracing); err != nil {
+		problems = append(problems, fmt.Errorf("tracing: %s", err))
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
@@ -1,26 +1,229 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 	clientConfig "traefik-cert-aggregator/clients/config"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	EnabledImporters []string `env:"ENABLED_IMPORTERS"`
-	EnabledExporters []string `env:"ENABLED_EXPORTERS"`
-	ImporterConfig   KeyedKVMap `env:"IMPORTER_CONFIG"`
-	ExporterConfig   KeyedKVMap `env:"EXPORTER_CONFIG"`
+	EnabledImporters []string            `env:"ENABLED_IMPORTERS" yaml:"enabledImporters"`
+	EnabledExporters []string            `env:"ENABLED_EXPORTERS" yaml:"enabledExporters"`
+	ImporterConfig   KeyedKVMap          `env:"IMPORTER_CONFIG" yaml:"importerConfig"`
+	ExporterConfig   KeyedKVMap          `env:"EXPORTER_CONFIG" yaml:"exporterConfig"`
+	Routes           map[string][]string `env:"ROUTES" yaml:"routes"`
+	HttpAddr         string              `env:"HTTP_ADDR" yaml:"httpAddr"`
+	AdminToken       string              `env:"ADMIN_TOKEN" yaml:"adminToken"`
+	StateFile        string              `env:"STATE_FILE" yaml:"stateFile"`
+	ShutdownTimeout  time.Duration       `env:"SHUTDOWN_TIMEOUT" yaml:"shutdownTimeout"`
+	ReloadInterval   time.Duration       `env:"CONFIG_RELOAD_INTERVAL" yaml:"reloadInterval"`
+	Encryption       EncryptionConfig    `yaml:"encryption"`
+	Supervisor       SupervisorConfig    `yaml:"supervisor"`
+	LeaderElection   LeaderConfig        `yaml:"leaderElection"`
+	Logging          LoggingConfig       `yaml:"logging"`
+	Tracing          TracingConfig       `yaml:"tracing"`
+
+	ExpiryWarningDays  int      `env:"EXPIRY_WARNING_DAYS" yaml:"expiryWarningDays"`
+	ExpiryCriticalDays int      `env:"EXPIRY_CRITICAL_DAYS" yaml:"expiryCriticalDays"`
+	AlertWebhookUrl    string   `env:"ALERT_WEBHOOK_URL" yaml:"alertWebhookUrl"`
+	SmtpAddr           string   `env:"SMTP_ADDR" yaml:"smtpAddr"`
+	SmtpFrom           string   `env:"SMTP_FROM" yaml:"smtpFrom"`
+	SmtpTo             []string `env:"SMTP_TO" yaml:"smtpTo"`
+	SmtpUsername       string   `env:"SMTP_USERNAME" yaml:"smtpUsername"`
+	SmtpPassword       string   `env:"SMTP_PASSWORD" yaml:"smtpPassword"`
+
+	WithholdExpired    bool          `env:"WITHHOLD_EXPIRED" yaml:"withholdExpired"`
+	ExpiredGracePeriod time.Duration `env:"EXPIRED_GRACE_PERIOD" yaml:"expiredGracePeriod"`
+	KeepLastExpired    bool          `env:"KEEP_LAST_EXPIRED" yaml:"keepLastExpired"`
+}
+
+// EncryptionConfig selects how private keys are encrypted at rest. Source is
+// one of file, transit or age; empty leaves keys unencrypted.
+type EncryptionConfig struct {
+	Source          string   `env:"KEY_ENCRYPTION" yaml:"source"`
+	KeyFile         string   `env:"KEY_ENCRYPTION_FILE" yaml:"keyFile"`
+	TransitMount    string   `env:"KEY_ENCRYPTION_TRANSIT_MOUNT" yaml:"transitMount"`
+	TransitKey      string   `env:"KEY_ENCRYPTION_TRANSIT_KEY" yaml:"transitKey"`
+	TransitAddr     string   `env:"KEY_ENCRYPTION_TRANSIT_ADDR" yaml:"transitAddr"`
+	TransitToken    string   `env:"KEY_ENCRYPTION_TRANSIT_TOKEN" yaml:"transitToken"`
+	AgeRecipients   []string `env:"KEY_ENCRYPTION_AGE_RECIPIENTS" yaml:"ageRecipients"`
+	AgeIdentityFile string   `env:"KEY_ENCRYPTION_AGE_IDENTITY" yaml:"ageIdentityFile"`
+}
+
+// SupervisorConfig controls how failed clients are restarted. Backoff
+// doubles from InitialBackoff up to MaxBackoff. After MaxFailures consecutive
+// failures a client is given up on; 0 retries forever.
+type SupervisorConfig struct {
+	InitialBackoff time.Duration `env:"CLIENT_BACKOFF_INITIAL" yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `env:"CLIENT_BACKOFF_MAX" yaml:"maxBackoff"`
+	MaxFailures    int           `env:"CLIENT_MAX_FAILURES" yaml:"maxFailures"`
+}
+
+// LeaderConfig enables leader election between instances. Backend is one of
+// consul or vault; empty runs every exporter on every instance.
+type LeaderConfig struct {
+	Backend    string        `env:"LEADER_ELECTION" yaml:"backend"`
+	Key        string        `env:"LEADER_KEY" yaml:"key"`
+	TTL        time.Duration `env:"LEADER_TTL" yaml:"ttl"`
+	ID         string        `env:"LEADER_ID" yaml:"id"`
+	VaultMount string        `env:"LEADER_VAULT_MOUNT" yaml:"vaultMount"`
+	Addr       string        `env:"LEADER_ADDR" yaml:"addr"`
+	Token      string        `env:"LEADER_TOKEN" yaml:"token"`
+}
+
+// LoggingConfig sets the level (debug, info, warn or error) and format
+// (logfmt or json) of the log. Clients can override the level with their
+// logLevel key.
+type LoggingConfig struct {
+	Level  string `env:"LOG_LEVEL" yaml:"level"`
+	Format string `env:"LOG_FORMAT" yaml:"format"`
+}
+
+// TracingConfig sends OTLP traces to Endpoint, either host:port or a URL.
+// Protocol is grpc or http/protobuf. An empty endpoint turns tracing off.
+type TracingConfig struct {
+	Endpoint    string  `env:"OTEL_EXPORTER_OTLP_ENDPOINT" yaml:"endpoint"`
+	Protocol    string  `env:"OTEL_EXPORTER_OTLP_PROTOCOL" yaml:"protocol"`
+	Insecure    bool    `env:"OTEL_EXPORTER_OTLP_INSECURE" yaml:"insecure"`
+	ServiceName string  `env:"OTEL_SERVICE_NAME" yaml:"serviceName"`
+	SampleRatio float64 `env:"OTEL_TRACES_SAMPLER_ARG" yaml:"sampleRatio"`
 }
 
 type KeyedKVMap map[string](clientConfig.ClientConfiguration)
 
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 func Load() Config {
 	cfg := Config{
-		ImporterConfig: KeyedKVMap{},
-		ExporterConfig: KeyedKVMap{},
+		ImporterConfig:     KeyedKVMap{},
+		ExporterConfig:     KeyedKVMap{},
+		ExpiryWarningDays:  21,
+		ExpiryCriticalDays: 7,
+		ShutdownTimeout:    5 * time.Second,
+		Supervisor: SupervisorConfig{
+			InitialBackoff: time.Second,
+			MaxBackoff:     5 * time.Minute,
+		},
+		LeaderElection: LeaderConfig{
+			Key:        "traefik-cert-aggregator/leader",
+			TTL:        15 * time.Second,
+			VaultMount: "kv",
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
+		Tracing: TracingConfig{
+			Protocol:    "grpc",
+			ServiceName: "traefik-cert-aggregator",
+			SampleRatio: 1,
+		},
 	}
 	return cfg
 }
 
+// LoadFile reads a yaml config file on top of the defaults. References like
+// ${VAULT_TOKEN} are replaced with the environment variable's value.
+func LoadFile(name string) (Config, error) {
+	cfg := Load()
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = yaml.Unmarshal(raw, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+	// Expanded after parsing, so values can't change the structure of the file
+	expandEnv(reflect.ValueOf(&cfg).Elem())
+	if cfg.ImporterConfig == nil {
+		cfg.ImporterConfig = KeyedKVMap{}
+	}
+	if cfg.ExporterConfig == nil {
+		cfg.ExporterConfig = KeyedKVMap{}
+	}
+	cfg.NormalizeNames()
+	return cfg, nil
+}
+
+// expandEnv replaces environment variable references in every string held
+// by v.
+func expandEnv(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(envReference.ReplaceAllStringFunc(v.String(), func(ref string) string {
+			return os.Getenv(envReference.FindStringSubmatch(ref)[1])
+		}))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			expandEnv(v.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandEnv(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			val := reflect.New(v.Type().Elem()).Elem()
+			val.Set(v.MapIndex(key))
+			expandEnv(val)
+			v.SetMapIndex(key, val)
+		}
+	}
+}
+
+// NormalizeNames lower cases the names clients are enabled, configured and
+// routed under, as names are matched regardless of case.
+func (c *Config) NormalizeNames() {
+	c.EnabledImporters = lowerAll(c.EnabledImporters)
+	c.EnabledExporters = lowerAll(c.EnabledExporters)
+	c.ImporterConfig = c.ImporterConfig.lowerKeys()
+	c.ExporterConfig = c.ExporterConfig.lowerKeys()
+	if c.Routes != nil {
+		routes := make(map[string][]string)
+		for importer, exporters := range c.Routes {
+			importer = strings.ToLower(importer)
+			routes[importer] = append(routes[importer], lowerAll(exporters)...)
+		}
+		c.Routes = routes
+	}
+}
+
+func lowerAll(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	ret := make([]string, len(names))
+	for i, name := range names {
+		ret[i] = strings.ToLower(name)
+	}
+	return ret
+}
+
+func (k KeyedKVMap) lowerKeys() KeyedKVMap {
+	if k == nil {
+		return nil
+	}
+	ret := make(KeyedKVMap)
+	for name, cc := range k {
+		name = strings.ToLower(name)
+		if ret[name] == nil {
+			ret[name] = make(clientConfig.ClientConfiguration)
+		}
+		for key, val := range cc {
+			ret[name][key] = val
+		}
+	}
+	return ret
+}
+
 func (k *KeyedKVMap) Get(key string) clientConfig.ClientConfiguration {
 	if _, ok := (*k)[key]; !ok {
 		(*k)[key] = make(clientConfig.ClientConfiguration)
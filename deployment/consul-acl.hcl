@@ -20,4 +20,9 @@ agent_prefix "" {
 
 node_prefix "" {
   policy = "read"
-}
\ No newline at end of file
+}
+
+# Only needed with LEADER_ELECTION=consul
+session_prefix "" {
+  policy = "write"
+}
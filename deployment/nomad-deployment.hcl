@@ -22,6 +22,10 @@ job "Network-Ingress" {
         static = 4443
       }
 
+      port "cert-agg" {
+        static = 9180
+      }
+
     }
     
 
@@ -37,7 +41,20 @@ job "Network-Ingress" {
     }
 
     task "cert-puller" {
-      driver = "docker"
+      driver       = "docker"
+      kill_timeout = "10s"
+
+      service {
+        name = "cert-puller"
+        port = "cert-agg"
+        check {
+          name     = "ready"
+          type     = "http"
+          path     = "/readyz"
+          interval = "10s"
+          timeout  = "2s"
+        }
+      }
       
       config {
         image        = "ghcr.io/clarkbains/cert-agg:latest"
@@ -52,6 +69,7 @@ job "Network-Ingress" {
         data = <<EOH
 VAULT_ADDR=https://192.168.25.137:8200
 TRAEFIK_BASE=/alloc/data/traefik
+HTTP_ADDR={{ env "NOMAD_ADDR_cert_agg" }}
         EOH
         destination = "local/file.env"
         change_mode   = "restart"
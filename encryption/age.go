@@ -0,0 +1,80 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"filippo.io/age"
+)
+
+// AgeKeySource encrypts to age X25519 recipients. The identity file is
+// required, so whatever is encrypted can be read back; without recipients,
+// keys are encrypted to the identities in it.
+type AgeKeySource struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+func NewAgeKeySource(recipients []string, identityFile string) (*AgeKeySource, error) {
+	v := AgeKeySource{}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		v.recipients = append(v.recipients, recipient)
+	}
+	if identityFile == "" {
+		return nil, errors.New("no age identity file configured")
+	}
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	v.identities, err = age.ParseIdentities(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.recipients) == 0 {
+		for _, identity := range v.identities {
+			if x, ok := identity.(*age.X25519Identity); ok {
+				v.recipients = append(v.recipients, x.Recipient())
+			}
+		}
+	}
+	if len(v.recipients) == 0 {
+		return nil, errors.New("no age recipients configured")
+	}
+	return &v, nil
+}
+
+func (v *AgeKeySource) Name() string {
+	return "age"
+}
+
+func (v *AgeKeySource) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, v.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (v *AgeKeySource) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), v.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,97 @@
+package encryption
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"traefik-cert-aggregator/config"
+)
+
+// BlockType is the PEM type of sealed private keys.
+const BlockType = "CERT-AGG ENCRYPTED KEY"
+
+// KeySource encrypts and decrypts private keys at rest.
+type KeySource interface {
+	Name() string
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// ErrUnavailable is wrapped by errors of a key source which could not be
+// reached, where trying again later may succeed. Other errors, like a wrong
+// key or corrupt ciphertext, will not go away.
+var ErrUnavailable = errors.New("key source unavailable")
+
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %s", ErrUnavailable, err)
+}
+
+var defaultSource KeySource
+var defaultSourceLock sync.Mutex
+
+// SetDefault sets the key source used for local state and exporters which
+// encrypt keys.
+func SetDefault(ks KeySource) {
+	defaultSourceLock.Lock()
+	defer defaultSourceLock.Unlock()
+	defaultSource = ks
+}
+
+// Default returns the configured key source, or nil if keys are stored in plain text.
+func Default() KeySource {
+	defaultSourceLock.Lock()
+	defer defaultSourceLock.Unlock()
+	return defaultSource
+}
+
+// FromConfig creates the key source described by the config. It returns nil
+// if no source is configured.
+func FromConfig(cfg config.EncryptionConfig) (KeySource, error) {
+	switch cfg.Source {
+	case "":
+		return nil, nil
+	case "file":
+		return NewFileKeySource(cfg.KeyFile)
+	case "transit":
+		return NewTransitKeySource(cfg.TransitMount, cfg.TransitKey, cfg.TransitAddr, cfg.TransitToken)
+	case "age":
+		return NewAgeKeySource(cfg.AgeRecipients, cfg.AgeIdentityFile)
+	}
+	return nil, fmt.Errorf("unknown key source \"%s\"", cfg.Source)
+}
+
+// Seal encrypts a private key into a PEM block recording the key source used.
+func Seal(ctx context.Context, ks KeySource, plaintext []byte) ([]byte, error) {
+	ciphertext, err := ks.Encrypt(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    BlockType,
+		Headers: map[string]string{"Source": ks.Name()},
+		Bytes:   ciphertext,
+	}), nil
+}
+
+// Open decrypts a key sealed with Seal.
+func Open(ctx context.Context, ks KeySource, sealed []byte) ([]byte, error) {
+	block, _ := pem.Decode(sealed)
+	if block == nil || block.Type != BlockType {
+		return nil, errors.New("not an encrypted key")
+	}
+	if ks == nil {
+		return nil, errors.New("key is encrypted but no key source is configured")
+	}
+	if source := block.Headers["Source"]; source != ks.Name() {
+		return nil, fmt.Errorf("key was encrypted with \"%s\", not \"%s\"", source, ks.Name())
+	}
+	return ks.Decrypt(ctx, block.Bytes)
+}
+
+// IsSealed reports whether data starts with a sealed key.
+func IsSealed(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == BlockType
+}
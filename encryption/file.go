@@ -0,0 +1,74 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// FileKeySource encrypts with AES-256-GCM using a key read from a local file.
+// The file holds 32 bytes, either raw, hex or base64 encoded.
+type FileKeySource struct {
+	aead cipher.AEAD
+}
+
+func NewFileKeySource(name string) (*FileKeySource, error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeySource{aead: aead}, nil
+}
+
+func decodeKey(raw []byte) ([]byte, error) {
+	if len(raw) == 32 {
+		return raw, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("key file must hold 32 bytes, raw, hex or base64 encoded")
+}
+
+func (v *FileKeySource) Name() string {
+	return "file"
+}
+
+func (v *FileKeySource) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (v *FileKeySource) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < v.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := ciphertext[:v.aead.NonceSize()]
+	return v.aead.Open(nil, nonce, ciphertext[v.aead.NonceSize():], nil)
+}
@@ -0,0 +1,90 @@
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"path"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// TransitKeySource encrypts with a key held by Vault's transit secrets
+// engine. The Vault address and token default to VAULT_ADDR and
+// VAULT_TOKEN.
+type TransitKeySource struct {
+	client *vault.Client
+	mount  string
+	key    string
+}
+
+func NewTransitKeySource(mount string, key string, addr string, token string) (*TransitKeySource, error) {
+	if key == "" {
+		return nil, errors.New("no transit key configured")
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+	vaultCfg := vault.DefaultConfig()
+	if addr != "" {
+		vaultCfg.Address = addr
+	}
+	client, err := vault.NewClient(vaultCfg)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		client.SetToken(token)
+	}
+	return &TransitKeySource{client: client, mount: mount, key: key}, nil
+}
+
+func (v *TransitKeySource) Name() string {
+	return "transit"
+}
+
+func (v *TransitKeySource) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	secret, err := v.client.Logical().WriteWithContext(ctx, path.Join(v.mount, "encrypt", v.key), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return nil, transitError(err)
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from transit")
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, errors.New("no ciphertext in transit response")
+	}
+	return []byte(ciphertext), nil
+}
+
+func (v *TransitKeySource) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	secret, err := v.client.Logical().WriteWithContext(ctx, path.Join(v.mount, "decrypt", v.key), map[string]interface{}{
+		"ciphertext": string(ciphertext),
+	})
+	if err != nil {
+		return nil, transitError(err)
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from transit")
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("no plaintext in transit response")
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+// transitError marks errors of requests which never got an answer, or got
+// one Vault may not give again, like a sealed or overloaded server, as
+// unavailable.
+func transitError(err error) error {
+	var resp *vault.ResponseError
+	if errors.As(err, &resp) && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return err
+	}
+	return unavailable(err)
+}
@@ -0,0 +1,135 @@
+package expiry
+
+import (
+	"context"
+	"strings"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/logging"
+	"traefik-cert-aggregator/metrics"
+	"traefik-cert-aggregator/notify"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var levels = map[string]int{
+	"":                   0,
+	notify.LevelWarning:  1,
+	notify.LevelCritical: 2,
+	notify.LevelExpired:  3,
+}
+
+var expiryLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metrics.Namespace,
+	Name:      "expiry_level",
+	Help:      "Expiry state of a certificate: 0 ok, 1 warning, 2 critical, 3 expired.",
+}, []string{"sender", "serial", "common_name"})
+
+func init() {
+	metrics.Registry.MustRegister(expiryLevel)
+}
+
+type Monitor struct {
+	Warning   time.Duration
+	Critical  time.Duration
+	Interval  time.Duration
+	Notifiers []notify.Notifier
+
+	// Highest level already alerted on, keyed by fingerprint.
+	fired map[string]string
+	// Label sets of the expiry gauge written by the last evaluation.
+	labels map[string][]string
+}
+
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	m.Evaluate(ctx, time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			m.Evaluate(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Monitor) level(notAfter time.Time, now time.Time) string {
+	remaining := notAfter.Sub(now)
+	switch {
+	case remaining <= 0:
+		return notify.LevelExpired
+	case remaining <= m.Critical:
+		return notify.LevelCritical
+	case remaining <= m.Warning:
+		return notify.LevelWarning
+	}
+	return ""
+}
+
+// Evaluate checks every held certificate, alerting once for every threshold
+// a certificate crosses.
+func (m *Monitor) Evaluate(ctx context.Context, now time.Time) {
+	m.evaluate(ctx, now, aggregator.HeldCerts())
+}
+
+// evaluate alerts on the given certificates. An alert counts as sent once a
+// notifier took it, until then it is tried again on every evaluation.
+func (m *Monitor) evaluate(ctx context.Context, now time.Time, certs []aggregator.HeldCert) {
+	if m.fired == nil {
+		m.fired = make(map[string]string)
+	}
+	seen := make(map[string]bool)
+	labels := make(map[string][]string)
+	for _, held := range certs {
+		cert := held.Cert.Cert
+		fingerprint := held.Cert.Fingerprint()
+		seen[fingerprint] = true
+
+		level := m.level(cert.NotAfter, now)
+		labelValues := []string{held.Sender, cert.SerialNumber.String(), cert.Subject.CommonName}
+		labels[strings.Join(labelValues, "\x00")] = labelValues
+		expiryLevel.WithLabelValues(labelValues...).Set(float64(levels[level]))
+		if levels[level] <= levels[m.fired[fingerprint]] {
+			continue
+		}
+
+		alert := notify.Alert{
+			Level:       level,
+			Sender:      held.Sender,
+			Domains:     held.Cert.Domains(),
+			Serial:      cert.SerialNumber.String(),
+			Fingerprint: fingerprint,
+			NotAfter:    cert.NotAfter,
+		}
+		logging.Warn(alert.Summary(), "sender", alert.Sender, "domain", strings.Join(alert.Domains, ","), "serial", alert.Serial, "alert", alert.Level)
+		sent := len(m.Notifiers) == 0
+		for _, n := range m.Notifiers {
+			err := n.Notify(ctx, alert)
+			if err != nil {
+				logging.Error("Could not send expiry alert", "notifier", n.Name(), "serial", alert.Serial, "error", err)
+				continue
+			}
+			sent = true
+		}
+		if sent {
+			m.fired[fingerprint] = level
+		}
+	}
+
+	// Only label sets of certificates no longer held are dropped, so a
+	// scrape never sees the gauge half empty
+	for key, labelValues := range m.labels {
+		if _, ok := labels[key]; !ok {
+			expiryLevel.DeleteLabelValues(labelValues...)
+		}
+	}
+	m.labels = labels
+
+	for fingerprint := range m.fired {
+		if !seen[fingerprint] {
+			delete(m.fired, fingerprint)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package expiry
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/notify"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// smtpStandIn accepts mail on a local port, or rejects it while failing is set.
+type smtpStandIn struct {
+	lis     net.Listener
+	lock    sync.Mutex
+	failing bool
+	mails   []string
+}
+
+func newSmtpStandIn(t *testing.T) *smtpStandIn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{lis: lis}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL"):
+			s.lock.Lock()
+			failing := s.failing
+			s.lock.Unlock()
+			if failing {
+				reply("451 try again later")
+				continue
+			}
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT"):
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var mail strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				mail.WriteString(line)
+			}
+			s.lock.Lock()
+			s.mails = append(s.mails, mail.String())
+			s.lock.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpStandIn) setFailing(failing bool) {
+	s.lock.Lock()
+	s.failing = failing
+	s.lock.Unlock()
+}
+
+// received returns the mails received so far and forgets them.
+func (s *smtpStandIn) received() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mails := s.mails
+	s.mails = nil
+	return mails
+}
+
+func heldCert(t *testing.T, sender string, domain string, serial int64, notAfter time.Time) aggregator.HeldCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aggregator.HeldCert{Sender: sender, Cert: aggregator.CertPackage{Cert: cert, Chain: []*x509.Certificate{cert}}}
+}
+
+func newMonitor(s *smtpStandIn) *Monitor {
+	return &Monitor{
+		Warning:   14 * 24 * time.Hour,
+		Critical:  3 * 24 * time.Hour,
+		Notifiers: []notify.Notifier{notify.NewSmtpNotifier(s.lis.Addr().String(), "agg@example.com", []string{"ops@example.com"}, "", "")},
+	}
+}
+
+func TestAlertsOncePerLevel(t *testing.T) {
+	s := newSmtpStandIn(t)
+	m := newMonitor(s)
+	now := time.Now()
+	certs := []aggregator.HeldCert{heldCert(t, "vault", "a.example.com", 1, now.Add(10*24*time.Hour))}
+
+	m.evaluate(context.Background(), now, certs)
+	mails := s.received()
+	if len(mails) != 1 || !strings.Contains(mails[0], "[WARNING]") || !strings.Contains(mails[0], "a.example.com") {
+		t.Fatalf("expected one warning for a.example.com, got %q", mails)
+	}
+
+	m.evaluate(context.Background(), now.Add(time.Hour), certs)
+	if mails := s.received(); len(mails) != 0 {
+		t.Fatalf("expected no repeated warning, got %q", mails)
+	}
+
+	m.evaluate(context.Background(), now.Add(8*24*time.Hour), certs)
+	if mails := s.received(); len(mails) != 1 || !strings.Contains(mails[0], "[CRITICAL]") {
+		t.Fatalf("expected one critical alert, got %q", mails)
+	}
+}
+
+func TestRetriesUndeliveredAlerts(t *testing.T) {
+	s := newSmtpStandIn(t)
+	m := newMonitor(s)
+	now := time.Now()
+	certs := []aggregator.HeldCert{heldCert(t, "vault", "b.example.com", 2, now.Add(-time.Hour))}
+
+	s.setFailing(true)
+	m.evaluate(context.Background(), now, certs)
+	if mails := s.received(); len(mails) != 0 {
+		t.Fatalf("expected the mail to be rejected, got %q", mails)
+	}
+
+	s.setFailing(false)
+	m.evaluate(context.Background(), now.Add(time.Minute), certs)
+	if mails := s.received(); len(mails) != 1 || !strings.Contains(mails[0], "[EXPIRED]") {
+		t.Fatalf("expected the expired alert to be sent again, got %q", mails)
+	}
+
+	m.evaluate(context.Background(), now.Add(2*time.Minute), certs)
+	if mails := s.received(); len(mails) != 0 {
+		t.Fatalf("expected no repeated alert once delivered, got %q", mails)
+	}
+}
+
+func TestDropsStaleGaugeLabels(t *testing.T) {
+	expiryLevel.Reset()
+	s := newSmtpStandIn(t)
+	m := newMonitor(s)
+	now := time.Now()
+	kept := heldCert(t, "vault", "c.example.com", 3, now.Add(60*24*time.Hour))
+	gone := heldCert(t, "vault", "d.example.com", 4, now.Add(60*24*time.Hour))
+
+	m.evaluate(context.Background(), now, []aggregator.HeldCert{kept, gone})
+	if n := testutil.CollectAndCount(expiryLevel); n != 2 {
+		t.Fatalf("expected 2 label sets, got %d", n)
+	}
+	m.evaluate(context.Background(), now, []aggregator.HeldCert{kept})
+	if n := testutil.CollectAndCount(expiryLevel); n != 1 {
+		t.Fatalf("expected 1 label set, got %d", n)
+	}
+	if v := testutil.ToFloat64(expiryLevel.WithLabelValues("vault", "3", "c.example.com")); v != 0 {
+		t.Fatalf("expected level 0 for c.example.com, got %v", v)
+	}
+}
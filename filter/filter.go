@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"traefik-cert-aggregator/util"
+)
+
+type matcher func(domain string) bool
+
+// Rules decide which certificates pass, based on the names they cover.
+// Every name has to match an include rule, if there are any, and none may
+// match an exclude rule. A nil Rules lets everything pass.
+type Rules struct {
+	include []matcher
+	exclude []matcher
+}
+
+// Parse builds rules from comma separated patterns. Patterns are domain globs
+// like *.example.com, or regular expressions when prefixed with re: or
+// wrapped in slashes. A regular expression has to match the whole name, and
+// commas within its brackets or braces, or escaped, belong to it.
+func Parse(include string, exclude string) (*Rules, error) {
+	var r Rules
+	var err error
+	r.include, err = parseMatchers(include)
+	if err != nil {
+		return nil, err
+	}
+	r.exclude, err = parseMatchers(exclude)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.include) == 0 && len(r.exclude) == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func parseMatchers(patterns string) ([]matcher, error) {
+	var matchers []matcher
+	for _, pattern := range splitPatterns(patterns) {
+
+		expr := ""
+		if strings.HasPrefix(pattern, "re:") {
+			expr = strings.TrimPrefix(pattern, "re:")
+		} else if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			expr = pattern[1 : len(pattern)-1]
+		}
+		if expr == "" {
+			glob := pattern
+			matchers = append(matchers, func(domain string) bool {
+				return util.MatchDomain(glob, domain)
+			})
+			continue
+		}
+
+		re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain pattern \"%s\": %s", pattern, err)
+		}
+		matchers = append(matchers, re.MatchString)
+	}
+	return matchers, nil
+}
+
+// splitPatterns splits a list of patterns on the commas between them.
+// Within a regular expression only a comma outside brackets and braces ends
+// it, and with slashes only one following the closing slash.
+func splitPatterns(patterns string) []string {
+	var ret []string
+	var cur strings.Builder
+	braces := 0
+	class, escaped := false, false
+	end := func() {
+		if pattern := strings.TrimSpace(cur.String()); pattern != "" {
+			ret = append(ret, pattern)
+		}
+		cur.Reset()
+		braces, class, escaped = 0, false, false
+	}
+	for _, c := range patterns {
+		pattern := strings.TrimSpace(cur.String())
+		slashed := strings.HasPrefix(pattern, "/")
+		inside := escaped || class || braces > 0
+		if c == ',' && !inside && (!slashed || len(pattern) > 1 && strings.HasSuffix(pattern, "/")) {
+			end()
+			continue
+		}
+		cur.WriteRune(c)
+		if !slashed && !strings.HasPrefix(pattern, "re:") {
+			continue
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case class:
+			class = c != ']'
+		case c == '[':
+			class = true
+		case c == '{':
+			braces++
+		case c == '}' && braces > 0:
+			braces--
+		}
+	}
+	end()
+	return ret
+}
+
+func matchesAny(matchers []matcher, domain string) bool {
+	for _, m := range matchers {
+		if m(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rules) Allows(domains []string) bool {
+	if r == nil {
+		return true
+	}
+	for _, domain := range domains {
+		if len(r.include) > 0 && !matchesAny(r.include, domain) {
+			return false
+		}
+		if matchesAny(r.exclude, domain) {
+			return false
+		}
+	}
+	return true
+}
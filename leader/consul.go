@@ -0,0 +1,84 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ConsulElector holds a Consul lock backed by a session, which Consul
+// releases once the session is no longer renewed. The agent address and
+// token default to CONSUL_HTTP_ADDR and CONSUL_HTTP_TOKEN.
+type ConsulElector struct {
+	client *consul.Client
+	key    string
+	id     string
+	ttl    time.Duration
+
+	lock     *consul.Lock
+	lockLock sync.Mutex
+}
+
+func NewConsulElector(key string, id string, ttl time.Duration, addr string, token string) (*ConsulElector, error) {
+	consulCfg := consul.DefaultConfig()
+	if addr != "" {
+		consulCfg.Address = addr
+	}
+	if token != "" {
+		consulCfg.Token = token
+	}
+	client, err := consul.NewClient(consulCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulElector{client: client, key: key, id: id, ttl: ttl}, nil
+}
+
+func (v *ConsulElector) Name() string {
+	return "consul"
+}
+
+func (v *ConsulElector) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	lock, err := v.client.LockOpts(&consul.LockOptions{
+		Key:         v.key,
+		Value:       []byte(v.id),
+		SessionName: "traefik-cert-aggregator " + v.id,
+		SessionTTL:  v.ttl.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	lost, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+	if lost == nil {
+		return nil, ctx.Err()
+	}
+
+	v.lockLock.Lock()
+	v.lock = lock
+	v.lockLock.Unlock()
+	go func() {
+		// Stops renewing the session of a lost lock
+		<-lost
+		lock.Unlock()
+	}()
+	return lost, nil
+}
+
+func (v *ConsulElector) Resign(ctx context.Context) error {
+	v.lockLock.Lock()
+	defer v.lockLock.Unlock()
+	if v.lock == nil {
+		return nil
+	}
+	err := v.lock.Unlock()
+	v.lock = nil
+	if err == consul.ErrLockNotHeld {
+		return nil
+	}
+	return err
+}
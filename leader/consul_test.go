@@ -0,0 +1,74 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// newTestConsulElector returns an elector on a Consul agent such as
+// `consul agent -dev`, at CONSUL_HTTP_ADDR or the default address. The test
+// is skipped when no agent answers.
+func newTestConsulElector(t *testing.T, key string, id string) *ConsulElector {
+	e, err := NewConsulElector(key, id, 10*time.Second, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.client.Status().Leader(); err != nil {
+		t.Skipf("no consul agent available: %s", err)
+	}
+	return e
+}
+
+func TestConsulElectorHandsOver(t *testing.T) {
+	key := fmt.Sprintf("traefik-cert-aggregator/test/%d", time.Now().UnixNano())
+	first := newTestConsulElector(t, key, "first")
+	second := newTestConsulElector(t, key, "second")
+	t.Cleanup(func() { first.client.KV().Delete(key, nil) })
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	defer stopFirst()
+	lost, err := first.Campaign(firstCtx)
+	if err != nil {
+		t.Fatalf("first campaign failed: %s", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	_, err = second.Campaign(waitCtx)
+	cancel()
+	if err == nil {
+		t.Fatal("second instance acquired leadership while the first held it")
+	}
+
+	pair, _, err := first.client.KV().Get(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair == nil || string(pair.Value) != "first" || pair.Session == "" {
+		t.Fatalf("expected the lock to be held by first, got %+v", pair)
+	}
+
+	stopFirst()
+	resignCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := first.Resign(resignCtx); err != nil {
+		t.Fatalf("resign failed: %s", err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership of the first instance was not lost after resigning")
+	}
+
+	secondCtx, stopSecond := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stopSecond()
+	if _, err := second.Campaign(secondCtx); err != nil {
+		t.Fatalf("second instance did not take over: %s", err)
+	}
+	if err := second.Resign(context.Background()); err != nil && err != consul.ErrLockNotHeld {
+		t.Fatalf("resign failed: %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/logging"
+)
+
+// Elector campaigns for a lock shared by every instance, so exporters which
+// write to shared systems only run on one of them.
+type Elector interface {
+	Name() string
+	// Campaign blocks until leadership was acquired or ctx is done. The
+	// returned channel is closed once leadership is lost.
+	Campaign(ctx context.Context) (<-chan struct{}, error)
+	// Resign gives up leadership, so another instance can take over
+	// without waiting for the lock to expire. It is called once the context
+	// given to Campaign is done.
+	Resign(ctx context.Context) error
+}
+
+// FromConfig creates the configured elector, nil when leader election is off.
+func FromConfig(cfg config.LeaderConfig) (Elector, error) {
+	id := cfg.ID
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "consul":
+		return NewConsulElector(cfg.Key, id, cfg.TTL, cfg.Addr, cfg.Token)
+	case "vault":
+		return NewVaultElector(cfg.VaultMount, cfg.Key, id, cfg.TTL, cfg.Addr, cfg.Token)
+	}
+	return nil, fmt.Errorf("unknown leader election backend \"%s\"", cfg.Backend)
+}
+
+// Run campaigns until ctx is done, calling changed whenever leadership is
+// acquired or lost. Leadership is given up before returning.
+func Run(ctx context.Context, e Elector, retry time.Duration, changed func(bool)) {
+	for {
+		lost, err := e.Campaign(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.Warn("Leader election failed, retrying", "backend", e.Name(), "retry", retry, "error", err)
+			select {
+			case <-time.After(retry):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		logging.Info("Acquired leadership", "backend", e.Name())
+		changed(true)
+		select {
+		case <-lost:
+			logging.Warn("Lost leadership", "backend", e.Name())
+			changed(false)
+		case <-ctx.Done():
+			changed(false)
+			resignCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := e.Resign(resignCtx)
+			cancel()
+			if err != nil {
+				logging.Error("Could not resign leadership", "backend", e.Name(), "error", err)
+			}
+			return
+		}
+	}
+}
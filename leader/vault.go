@@ -0,0 +1,169 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// VaultElector holds a lease stored in a KV v2 secret, which is taken over
+// once its holder stops renewing it. Writes use check-and-set, so only one
+// instance can take or renew the lease at a time. Expiry is compared with
+// the local clock, so the hosts' clocks have to be in sync well within the
+// TTL. The Vault address and token default to VAULT_ADDR and VAULT_TOKEN.
+type VaultElector struct {
+	client *vault.Client
+	mount  string
+	key    string
+	id     string
+	ttl    time.Duration
+
+	// Version of the secret written by the last successful take or renewal
+	version int64
+	// Closed once the lease is no longer renewed
+	renewed chan struct{}
+}
+
+type vaultLease struct {
+	holder  string
+	expires time.Time
+	version int64
+}
+
+func NewVaultElector(mount string, key string, id string, ttl time.Duration, addr string, token string) (*VaultElector, error) {
+	vaultCfg := vault.DefaultConfig()
+	if addr != "" {
+		vaultCfg.Address = addr
+	}
+	client, err := vault.NewClient(vaultCfg)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		client.SetToken(token)
+	}
+	return &VaultElector{client: client, mount: mount, key: key, id: id, ttl: ttl}, nil
+}
+
+func (v *VaultElector) Name() string {
+	return "vault"
+}
+
+func (v *VaultElector) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	for {
+		lease, err := v.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if lease.holder == "" || lease.holder == v.id || time.Now().After(lease.expires) {
+			err = v.write(ctx, lease.version, time.Now().Add(v.ttl))
+			if err == nil {
+				break
+			}
+		}
+
+		select {
+		case <-time.After(v.ttl / 3):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	lost := make(chan struct{})
+	v.renewed = lost
+	go v.renew(ctx, lost)
+	return lost, nil
+}
+
+// renew extends the lease until renewing fails or ctx is done. A lease
+// which could not be renewed counts as lost right away, rather than when it
+// expires, so two instances never both think they are leading.
+func (v *VaultElector) renew(ctx context.Context, lost chan struct{}) {
+	defer close(lost)
+	ticker := time.NewTicker(v.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		err := v.write(ctx, v.version, time.Now().Add(v.ttl))
+		if err != nil {
+			if ctx.Err() == nil {
+				v.version = 0
+			}
+			return
+		}
+	}
+}
+
+func (v *VaultElector) Resign(ctx context.Context) error {
+	if v.renewed == nil {
+		return nil
+	}
+	<-v.renewed
+	v.renewed = nil
+	if v.version == 0 {
+		return nil
+	}
+	err := v.write(ctx, v.version, time.Time{})
+	v.version = 0
+	return err
+}
+
+func (v *VaultElector) read(ctx context.Context) (vaultLease, error) {
+	secret, err := v.client.Logical().ReadWithContext(ctx, path.Join(v.mount, "data", v.key))
+	if err != nil || secret == nil {
+		return vaultLease{}, err
+	}
+
+	var lease vaultLease
+	if metadata, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+		if n, ok := metadata["version"].(json.Number); ok {
+			lease.version, _ = n.Int64()
+		}
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	lease.holder, _ = data["holder"].(string)
+	expires, _ := data["expires"].(string)
+	if expires != "" {
+		lease.expires, err = time.Parse(time.RFC3339Nano, expires)
+		if err != nil {
+			return vaultLease{}, fmt.Errorf("could not parse lease expiry: %s", err)
+		}
+	}
+	return lease, nil
+}
+
+// write stores the lease if the secret is still at the given version. A
+// zero expiry releases it.
+func (v *VaultElector) write(ctx context.Context, version int64, expires time.Time) error {
+	holder := v.id
+	if expires.IsZero() {
+		holder = ""
+	}
+	secret, err := v.client.Logical().WriteWithContext(ctx, path.Join(v.mount, "data", v.key), map[string]interface{}{
+		"options": map[string]interface{}{
+			"cas": version,
+		},
+		"data": map[string]interface{}{
+			"holder":  holder,
+			"expires": expires.Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("empty response from vault")
+	}
+	n, _ := secret.Data["version"].(json.Number)
+	v.version, _ = n.Int64()
+	return nil
+}
@@ -0,0 +1,255 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJson   = "json"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level \"%s\"", name)
+}
+
+// ParseFormat checks that a format is logfmt or json.
+func ParseFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case FormatLogfmt:
+		return FormatLogfmt, nil
+	case FormatJson:
+		return FormatJson, nil
+	}
+	return "", fmt.Errorf("unknown log format \"%s\"", name)
+}
+
+var (
+	lock         sync.RWMutex
+	out          io.Writer = os.Stderr
+	format                 = FormatLogfmt
+	level                  = LevelInfo
+	clientLevels           = make(map[string]Level)
+	// Keeps lines from different goroutines apart
+	writeLock sync.Mutex
+)
+
+func init() {
+	// Anything still using the log package, including libraries, goes
+	// through the same formatting and redaction.
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+}
+
+// Configure sets the level and format every logger uses, unless a client
+// has a level of its own.
+func Configure(levelName string, formatName string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	f, err := ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	level, format = l, f
+	return nil
+}
+
+// SetOutput changes where log lines are written to.
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	out = w
+}
+
+// SetClientLevel overrides the level for one client. An empty level falls
+// back to the global one.
+func SetClientLevel(kind string, name string, levelName string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	if levelName == "" {
+		delete(clientLevels, kind+"/"+name)
+		return nil
+	}
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	clientLevels[kind+"/"+name] = l
+	return nil
+}
+
+// Logger writes leveled log lines, with fields added to every line.
+type Logger struct {
+	fields []interface{}
+	// kind/name of the client whose level applies, empty for the global one
+	client string
+}
+
+var root = &Logger{}
+
+// Client returns a logger for an importer or exporter, which honours the
+// client's own level.
+func Client(kind string, name string) *Logger {
+	return &Logger{fields: []interface{}{"client", name, "kind", kind}, client: kind + "/" + name}
+}
+
+// With returns a logger adding the given key value pairs to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	return &Logger{fields: append(append([]interface{}{}, l.fields...), kv...), client: l.client}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal logs an error and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func With(kv ...interface{}) *Logger      { return root.With(kv...) }
+func Debug(msg string, kv ...interface{}) { root.log(LevelDebug, msg, kv) }
+func Info(msg string, kv ...interface{})  { root.log(LevelInfo, msg, kv) }
+func Warn(msg string, kv ...interface{})  { root.log(LevelWarn, msg, kv) }
+func Error(msg string, kv ...interface{}) { root.log(LevelError, msg, kv) }
+func Fatal(msg string, kv ...interface{}) { root.Fatal(msg, kv...) }
+
+// Enabled reports whether lines of a level would be written, to skip
+// building expensive fields.
+func (l *Logger) Enabled(lvl Level) bool {
+	min, _, _ := l.settings()
+	return lvl >= min
+}
+
+func (l *Logger) settings() (Level, string, io.Writer) {
+	lock.RLock()
+	defer lock.RUnlock()
+	min := level
+	if clientLevel, ok := clientLevels[l.client]; ok {
+		min = clientLevel
+	}
+	return min, format, out
+}
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	min, f, w := l.settings()
+	if lvl < min {
+		return
+	}
+
+	fields := []interface{}{"time", time.Now().Format(time.RFC3339Nano), "level", lvl.String(), "msg", redactString(msg)}
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, nil)
+	}
+
+	var buf bytes.Buffer
+	if f == FormatJson {
+		writeJson(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	w.Write(buf.Bytes())
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		key := fmt.Sprint(fields[i])
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		val := fmt.Sprint(redact(key, fields[i+1]))
+		if needsQuoting(val) {
+			buf.WriteString(strconv.Quote(val))
+		} else {
+			buf.WriteString(val)
+		}
+	}
+}
+
+func needsQuoting(val string) bool {
+	if val == "" {
+		return true
+	}
+	for _, r := range val {
+		if r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJson(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key := fmt.Sprint(fields[i])
+		encoded, _ := json.Marshal(key)
+		buf.Write(encoded)
+		buf.WriteByte(':')
+		encoded, err := json.Marshal(redact(key, fields[i+1]))
+		if err != nil {
+			encoded, _ = json.Marshal(err.Error())
+		}
+		buf.Write(encoded)
+	}
+	buf.WriteByte('}')
+}
+
+// stdWriter turns lines from the log package into info lines.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	root.log(LevelInfo, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+// Fields whose values are never logged. A key matches if it is one of these
+// names, or if its last word is, ignoring case, so adminToken and
+// smtp_password match while a count of secrets does not.
+var sensitiveKeys = map[string]bool{
+	"token": true, "password": true, "passwd": true, "secret": true, "passphrase": true, "credential": true, "credentials": true,
+	"privatekey": true, "apikey": true, "authorization": true, "cookie": true,
+}
+
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// PEM encoded private and encrypted keys, possibly cut off
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 -]*KEY-----.*?(-----END [A-Z0-9 -]*KEY-----|$)`), redacted},
+	// Vault service, batch and recovery tokens, old and new style
+	{regexp.MustCompile(`\bhv[sbr]\.[A-Za-z0-9_-]{20,}`), redacted},
+	{regexp.MustCompile(`\b[sbr]\.[A-Za-z0-9]{24}\b`), redacted},
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[^\s"',]+`), "$1 " + redacted},
+	// Credentials in URLs
+	{regexp.MustCompile(`(://[^/\s:@]*:)[^/\s@]+@`), "${1}" + redacted + "@"},
+	// key=value pairs in free text and query strings, and "key": "value"
+	// in JSON. Text like "token: permission denied" is left alone, configured
+	// values are caught by AddSecret instead.
+	{regexp.MustCompile(`(?i)((?:token|password|passwd|secret|api[_-]?key)=)[^\s"',&]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)("(?:token|password|passwd|secret|api[_-]?key)"\s*:\s*")[^"]+`), "${1}" + redacted},
+}
+
+// Word boundaries in keys, between a lower and an upper case letter or at
+// a separator.
+var keyWordBoundary = regexp.MustCompile(`([a-z0-9])([A-Z])|[_\-. ]+`)
+
+func sensitiveKey(key string) bool {
+	words := strings.Fields(keyWordBoundary.ReplaceAllString(key, "$1 $2"))
+	if len(words) == 0 {
+		return false
+	}
+	return sensitiveKeys[strings.ToLower(strings.Join(words, ""))] || sensitiveKeys[strings.ToLower(words[len(words)-1])]
+}
+
+var (
+	secretsLock sync.RWMutex
+	secrets     = make(map[string]bool)
+)
+
+// AddSecret makes sure a value, like a configured token, never shows up in
+// a log line. Very short values are ignored, as hiding them would mangle
+// unrelated text.
+func AddSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < 4 {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secrets[secret] = true
+}
+
+// redact turns a field value into something safe to log: a string, number,
+// bool or nil.
+func redact(key string, val interface{}) interface{} {
+	if sensitiveKey(key) {
+		return redacted
+	}
+
+	switch v := val.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return redactString(v)
+	case []byte, *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, crypto.Signer, crypto.Decrypter:
+		return redacted
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case error:
+		return redactString(v.Error())
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+	return redactString(fmt.Sprint(val))
+}
+
+func redactString(s string) string {
+	for _, r := range redactions {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	for secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
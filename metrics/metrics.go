@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var Registry = prometheus.NewRegistry()
+
+// Namespace prefixes the aggregator's own metrics, so they don't collide
+// with those of other exporters in a shared Prometheus.
+const Namespace = "cert_agg"
+
+var (
+	PollErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "importer_poll_errors_total",
+		Help:      "Number of times an importer failed to fetch certificates.",
+	}, []string{"client"})
+
+	DiffCerts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "importer_diff_certs_total",
+		Help:      "Number of certificates added or removed by an importer.",
+	}, []string{"client", "change"})
+
+	ExportFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "exporter_write_failures_total",
+		Help:      "Number of failed writes by an exporter.",
+	}, []string{"client"})
+
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "leader",
+		Help:      "1 while this instance holds leadership, with leader election enabled.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		PollErrors,
+		DiffCerts,
+		ExportFailures,
+		Leader,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ExportFailureCount returns how many writes an exporter has failed so far.
+func ExportFailureCount(name string) float64 {
+	var m dto.Metric
+	err := ExportFailures.WithLabelValues(name).Write(&m)
+	if err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	LevelWarning  = "warning"
+	LevelCritical = "critical"
+	LevelExpired  = "expired"
+)
+
+type Alert struct {
+	Level       string    `json:"level"`
+	Sender      string    `json:"sender"`
+	Domains     []string  `json:"domains"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+func (a Alert) Summary() string {
+	return fmt.Sprintf("[%s] certificate for %s from \"%s\" expires %s",
+		strings.ToUpper(a.Level), strings.Join(a.Domains, ", "), a.Sender, a.NotAfter.Format(time.RFC1123))
+}
+
+type Notifier interface {
+	Name() string
+	Notify(context.Context, Alert) error
+}
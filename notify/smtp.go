@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type SmtpNotifier struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+// NewSmtpNotifier sends alerts by mail. Authentication is only used when a
+// username is given.
+func NewSmtpNotifier(addr string, from string, to []string, username string, password string) *SmtpNotifier {
+	n := SmtpNotifier{
+		addr: addr,
+		from: from,
+		to:   to,
+	}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &n
+}
+
+func (n *SmtpNotifier) Name() string {
+	return "smtp"
+}
+
+func (n *SmtpNotifier) Notify(ctx context.Context, alert Alert) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", alert.Summary())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "Domains: %s\r\n", strings.Join(alert.Domains, ", "))
+	fmt.Fprintf(&msg, "Sender: %s\r\n", alert.Sender)
+	fmt.Fprintf(&msg, "Serial: %s\r\n", alert.Serial)
+	fmt.Fprintf(&msg, "Fingerprint: %s\r\n", alert.Fingerprint)
+	fmt.Fprintf(&msg, "Not after: %s\r\n", alert.NotAfter.Format(time.RFC1123))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.addr, n.auth, n.from, n.to, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
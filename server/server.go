@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+	"traefik-cert-aggregator/logging"
+)
+
+var mux = http.NewServeMux()
+
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+func ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logging.Info("HTTP server listening", "addr", addr)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"traefik-cert-aggregator/config"
+	"traefik-cert-aggregator/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "traefik-cert-aggregator"
+
+// Tracer returns the tracer every span is started with. Until Setup was
+// called with an endpoint, its spans are not recorded.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup sends spans to the configured OTLP endpoint. The returned function
+// flushes whatever was not sent yet, and has to be called before exiting.
+// Without an endpoint tracing stays off.
+func Setup(cfg config.TracingConfig) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	exporter := otlptrace.NewUnstarted(client)
+	err = exporter.Start(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logging.Warn("Could not export spans", "error", err)
+	}))
+	logging.Info("Sending traces", "endpoint", cfg.Endpoint, "protocol", cfg.Protocol)
+	return provider.Shutdown, nil
+}
+
+// newClient picks the OTLP transport. The endpoint is either host:port, or
+// a URL whose scheme decides whether TLS is used.
+func newClient(cfg config.TracingConfig) (otlptrace.Client, error) {
+	endpoint, path, insecure := cfg.Endpoint, "", cfg.Insecure
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP endpoint: %s", err)
+		}
+		endpoint, path, insecure = u.Host, u.Path, u.Scheme == "http"
+	}
+
+	switch cfg.Protocol {
+	case "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+		if insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.NewClient(opts...), nil
+	case "http/protobuf":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+		if path != "" && path != "/" {
+			opts = append(opts, otlptracehttp.WithURLPath(path))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.NewClient(opts...), nil
+	}
+	return nil, fmt.Errorf("unknown OTLP protocol \"%s\"", cfg.Protocol)
+}
+
+// Validate checks the settings Setup would reject.
+func Validate(cfg config.TracingConfig) error {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("sample ratio has to be between 0 and 1, got %g", cfg.SampleRatio)
+	}
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	_, err := newClient(cfg)
+	return err
+}
+
+// RecordError marks a span as failed.
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,89 @@
+package tracing_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"traefik-cert-aggregator/aggregator"
+	"traefik-cert-aggregator/clients/config"
+	"traefik-cert-aggregator/clients/exporters"
+	"traefik-cert-aggregator/clients/importers"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The aggregator can't be restarted within a process, so it is started
+// once and left running for repeated runs of the test.
+var startAggregator sync.Once
+
+// A poll, the aggregator handling its change and the exporter applying it
+// end up in a single trace.
+func TestChangeIsOneTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	startAggregator.Do(func() { go aggregator.StartAggregating(context.Background()) })
+	exportCtx, stopExporter := context.WithCancel(ctx)
+	defer stopExporter()
+
+	out := exporters.NewStdoutExportClient("stdout")
+	if err := out.Configure(config.ClientConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	go out.Start(&exportCtx, aggregator.NewOutputChan("stdout"))
+
+	// A sender of its own, so the poll changes what is held on every run
+	in := importers.NewMockClient(fmt.Sprintf("mock-%d", time.Now().UnixNano()))
+	if err := in.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregator.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exporter marks a change applied just before ending its span
+	var poll, change, apply tracetest.SpanStub
+	for apply.Name == "" {
+		for _, span := range exporter.GetSpans() {
+			switch span.Name {
+			case "importer.poll":
+				poll = span
+			case "aggregator.change":
+				change = span
+			case "exporter.apply":
+				if span.SpanContext.TraceID() == poll.SpanContext.TraceID() {
+					apply = span
+				}
+			}
+		}
+		if apply.Name == "" {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("no exporter.apply span in the trace of the poll, got %d spans", len(exporter.GetSpans()))
+			}
+		}
+	}
+
+	if !poll.SpanContext.IsValid() || !change.SpanContext.IsValid() {
+		t.Fatalf("missing spans: poll %v, change %v", poll.SpanContext.IsValid(), change.SpanContext.IsValid())
+	}
+	traceID := poll.SpanContext.TraceID()
+	if change.SpanContext.TraceID() != traceID || apply.SpanContext.TraceID() != traceID {
+		t.Fatalf("spans are in different traces: poll %s, change %s, apply %s", traceID, change.SpanContext.TraceID(), apply.SpanContext.TraceID())
+	}
+	if change.Parent.SpanID() != poll.SpanContext.SpanID() {
+		t.Errorf("aggregator.change is not a child of importer.poll")
+	}
+	if apply.Parent.SpanID() != change.SpanContext.SpanID() {
+		t.Errorf("exporter.apply is not a child of aggregator.change")
+	}
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchDomain matches a domain against a glob pattern, where * matches
+// within a single label, the same way a wildcard certificate does.
+func MatchDomain(pattern string, domain string) bool {
+	pattern = strings.ReplaceAll(strings.ToLower(pattern), ".", "/")
+	domain = strings.ReplaceAll(strings.ToLower(domain), ".", "/")
+	ok, err := path.Match(pattern, domain)
+	return err == nil && ok
+}
+
+func MatchAnyDomain(patterns []string, domains []string) bool {
+	for _, pattern := range patterns {
+		for _, domain := range domains {
+			if MatchDomain(pattern, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}